@@ -0,0 +1,34 @@
+package anet
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// pinThread locks the calling goroutine to its OS thread and restricts that
+// thread to cpu. The thread goes away with the goroutine, so it never runs
+// other goroutines with the restricted affinity.
+func pinThread(cpu int) error {
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Set(cpu)
+	return unix.SchedSetaffinity(0, &set)
+}
+
+// availableCPUs lists the CPUs the process may run on.
+func availableCPUs() ([]int, error) {
+	var set unix.CPUSet
+	err := unix.SchedGetaffinity(0, &set)
+	if err != nil {
+		return nil, err
+	}
+	n := set.Count()
+	cpus := make([]int, 0, n)
+	for cpu := 0; len(cpus) < n; cpu++ {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
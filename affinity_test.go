@@ -0,0 +1,65 @@
+package anet
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestAutoCPUAffinity(t *testing.T) {
+	var allowed unix.CPUSet
+	require.NoError(t, unix.SchedGetaffinity(0, &allowed))
+	var cpus []int
+	for cpu := 0; len(cpus) < 2 && cpu < 1024; cpu++ {
+		if allowed.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) < 2 {
+		t.Skip("pinned threads can only be told apart with two cpus or more")
+	}
+	m := newTestRingManager(t, WithRingNum(2), WithAutoCPUAffinity(), WithSQPoll(10*time.Millisecond))
+	useRingManager(t, m)
+	_, addr := serveLoop(t, handleEcho)
+
+	connection, err := Dial("tcp", addr)
+	require.NoError(t, err)
+	defer connection.Close()
+	echo(t, connection, 10, 48)
+
+	// the rings go to the allowed cpus in turn, each one with a thread for
+	// its submission loop, one for its completion loop and a poller
+	pinned := make(map[int]int)
+	pollers := 0
+	tasks, err := os.ReadDir("/proc/self/task")
+	require.NoError(t, err)
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		var set unix.CPUSet
+		if unix.SchedGetaffinity(tid, &set) != nil || set.Count() != 1 {
+			continue
+		}
+		for _, cpu := range cpus {
+			if set.IsSet(cpu) {
+				pinned[cpu]++
+			}
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc/self/task", task.Name(), "comm"))
+		if err == nil && strings.HasPrefix(string(comm), "iou-sqp") {
+			pollers++
+		}
+	}
+	for _, cpu := range cpus {
+		require.GreaterOrEqual(t, pinned[cpu], 2, "threads pinned to cpu %d", cpu)
+	}
+	require.GreaterOrEqual(t, pollers, 2)
+}
@@ -47,6 +47,12 @@ func (s *Server) Start(address string) error {
 	if err != nil {
 		panic("shouldn't failed here")
 	}
+	return s.Serve(listener)
+}
+
+// Serve serves requests on a listener created with anet.CreateListener, so
+// that the caller knows the address before the first request comes in.
+func (s *Server) Serve(listener net.Listener) error {
 	eventLoop, err := anet.NewEventLoop(s.handleConnection)
 	if err != nil {
 		panic("shouldn't failed here")
@@ -81,7 +87,7 @@ func (s *Server) add(method, path string, handler HandlerFunc, middleware ...Mid
 	})
 }
 
-func (s *Server) handleConnection(_ context.Context, connection anet.Connection) error {
+func (s *Server) handleConnection(ctx context.Context, connection anet.Connection) error {
 	reader := bufio.NewReader(connection)
 	writer := connection.Writer()
 	for {
@@ -95,6 +101,9 @@ func (s *Server) handleConnection(_ context.Context, connection anet.Connection)
 		if err != nil {
 			return err
 		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 	}
 }
 
@@ -2,15 +2,27 @@ package anet
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
-	"strings"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 func CreateListener(network, addr string) (net.Listener, error) {
-	return net.Listen(network, addr)
+	ln, err := net.Listen(network, addr)
+	if err != nil && network == "unix" && errors.Is(err, syscall.EADDRINUSE) && isStaleSocket(addr) {
+		log.Warnf("remove stale unix socket file %s", addr)
+		_ = os.Remove(addr)
+		ln, err = net.Listen(network, addr)
+	}
+	return ln, err
 }
 
 func NewEventLoop(onRequest OnRequest, ops ...Option) (EventLoop, error) {
@@ -20,48 +32,396 @@ func NewEventLoop(onRequest OnRequest, ops ...Option) (EventLoop, error) {
 	for _, do := range ops {
 		do.f(opts)
 	}
-	return &eventLoop{
-		id:   uuid.New().String()[:8],
-		opts: opts,
-	}, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	evl := &eventLoop{
+		id:     uuid.New().String()[:8],
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[*connection]struct{}),
+		pconns: make(map[PacketConnection]struct{}),
+	}
+	if len(opts.latencyBuckets) > 0 {
+		evl.stats.latency = newLatencyHistogram(opts.latencyBuckets)
+	}
+	return evl, nil
 }
 
 type EventLoop interface {
 	Serve(ln net.Listener) error
+	ServePacket(connection PacketConnection) error
 	Shutdown(ctx context.Context) error
+	Stats() EventLoopStats
 }
 
 type OnRequest func(ctx context.Context, connection Connection) error
 
+type OnAcceptError func(err error)
+
+const shutdownPollInterval = 10 * time.Millisecond
+
+// bounds of the delay before an accept or a packet read is tried again after
+// the process or the system ran out of fds or memory
+const (
+	minRetryBackoff = 5 * time.Millisecond
+	maxRetryBackoff = time.Second
+)
+
 type eventLoop struct {
-	id   string
-	opts *options
-	ln   net.Listener
+	id        string
+	opts      *options
+	ln        net.Listener
+	fd        int
+	operator  *FDOperator
+	multishot bool
+	closed    int32
+	done      chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	conns     map[*connection]struct{}
+	pconns    map[PacketConnection]struct{}
+	mu        sync.Mutex
+	stats     loopStats
+	// only touched by accept completions, which never overlap
+	acceptBackoff time.Duration
 }
 
 func (evl *eventLoop) Serve(ln net.Listener) error {
+	fd, err := listenerFD(ln)
+	if err != nil {
+		return err
+	}
+	evl.mu.Lock()
+	if atomic.LoadInt32(&evl.closed) != 0 {
+		evl.mu.Unlock()
+		return ErrEventLoopClosed
+	}
 	evl.ln = ln
+	evl.fd = fd
+	evl.multishot = true
+	evl.done = make(chan struct{})
+	evl.mu.Unlock()
+
+	ring := GetRingManager().Pick(nil)
+	op := ring.Alloc()
+	op.FD = fd
+	op.OnAccept = evl.onAcceptEvent
+	op.Ring = ring
+	op.Register()
+	evl.operator = op
+
+	evl.submitAccept()
+	<-evl.done
+	log.Warnf("[eventloop %s] eventloop quit since listener closed", evl.id)
+	return nil
+}
+
+func (evl *eventLoop) ServePacket(connection PacketConnection) error {
+	if evl.opts.onPacket == nil {
+		return ErrNoPacketHandler
+	}
+	evl.mu.Lock()
+	if atomic.LoadInt32(&evl.closed) != 0 {
+		evl.mu.Unlock()
+		return ErrEventLoopClosed
+	}
+	evl.pconns[connection] = struct{}{}
+	evl.mu.Unlock()
+	defer func() {
+		evl.mu.Lock()
+		delete(evl.pconns, connection)
+		evl.mu.Unlock()
+	}()
+
+	buffer := make([]byte, maxPacketSize)
+	var backoff time.Duration
 	for {
-		conn, err := evl.ln.Accept()
-		if err != nil {
-			if strings.Contains(err.Error(), "closed") {
-				log.Warnf("[eventloop %s] eventloop quit since listener closed", evl.id)
-				return nil
-			}
-			log.Warnf("[evetloop %s] listener accepted with error, wait 10 ms for retry", evl.id)
-			time.Sleep(10 * time.Millisecond)
+		n, addr, err := connection.ReadFrom(buffer)
+		if err == ErrConnClosed {
+			return nil
+		}
+		if err != nil && isPeerError(err) {
+			log.Warnf("[eventloop %s] packet connection %s read with error: %s", evl.id, connection.ID(), err.Error())
 			continue
 		}
-		go evl.onAccept(conn)
+		if err != nil && (isResourceExhausted(err) || err == syscall.EAGAIN || err == syscall.EINTR) {
+			backoff = nextBackoff(backoff)
+			log.Warnf("[eventloop %s] packet connection %s read with error, retry in %s: %s", evl.id, connection.ID(), backoff, err.Error())
+			time.Sleep(backoff)
+			continue
+		}
+		if err != nil {
+			log.Warnf("[eventloop %s] packet connection %s read with error: %s", evl.id, connection.ID(), err.Error())
+			return err
+		}
+		backoff = 0
+		err = evl.opts.onPacket(evl.ctx, connection, buffer[:n], addr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (evl *eventLoop) onAcceptEvent(fd int, more bool, err error) {
+	if err == nil {
+		evl.acceptBackoff = 0
+		go evl.onAccept(fd)
+	} else if atomic.LoadInt32(&evl.closed) == 0 && err != syscall.ECANCELED {
+		// an accept cancelled while the operator migrates is submitted
+		// again
+		if evl.multishot && err == syscall.EINVAL {
+			log.Warnf("[eventloop %s] multishot accept is not supported, fall back to single accept", evl.id)
+			evl.multishot = false
+		} else if evl.opts.onAcceptError != nil {
+			evl.opts.onAcceptError(err)
+		} else {
+			log.Warnf("[eventloop %s] listener accepted with error: %s", evl.id, err.Error())
+		}
+	}
+	if more {
+		return
+	}
+	if atomic.LoadInt32(&evl.closed) != 0 {
+		// the ring still has to account for this completion, so the
+		// operator is released once it has drained
+		evl.operator.Drain(func() {
+			evl.operator.Free()
+			close(evl.done)
+		})
+		return
+	}
+	if isResourceExhausted(err) {
+		// accepting again right away fails the same way until fds or memory
+		// have been freed, and the completion goroutine must not sleep
+		evl.acceptBackoff = nextBackoff(evl.acceptBackoff)
+		time.AfterFunc(evl.acceptBackoff, evl.submitAccept)
+		return
+	}
+	evl.submitAccept()
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	return min(max(2*backoff, minRetryBackoff), maxRetryBackoff)
+}
+
+func isResourceExhausted(err error) bool {
+	return err == syscall.EMFILE || err == syscall.ENFILE || err == syscall.ENOBUFS || err == syscall.ENOMEM
+}
+
+// isPeerError reports whether err was queued on a datagram socket for an
+// earlier packet, it says nothing about the socket itself.
+func isPeerError(err error) bool {
+	switch err {
+	case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.EHOSTDOWN:
+		return true
+	default:
+		return false
 	}
 }
 
-func (evl *eventLoop) onAccept(conn net.Conn) {
+func (evl *eventLoop) onAccept(fd int) {
+	var raddr net.Addr
+	if sa, err := syscall.Getpeername(fd); err == nil {
+		raddr = netAddrFromSockaddr(sa)
+	}
 	connection := &connection{}
-	connection.init(conn, evl.opts)
-	connection.run()
+	connection.init(fd, raddr, evl.opts)
+	// the buffers outlive a close until the handler has returned
+	connection.holdBuffers()
+	defer connection.releaseBuffers()
+	connection.context = evl.ctx
+	connection.loopClosed = &evl.closed
+	connection.stats = &evl.stats
+	if evl.stats.latency != nil {
+		connection.latency = evl.stats.latency.empty()
+	}
+	connection.observer = evl.opts.observer
+	if connection.observer != nil {
+		if info, ok := connection.openInfo(); ok {
+			connection.observer.OnAccept(info, raddr)
+		}
+	}
+	if !evl.addConnection(connection) {
+		connection.setCloseReason(ErrEventLoopClosed)
+		_ = connection.Close()
+		return
+	}
+	defer evl.delConnection(connection)
+
+	var handle Connection = connection
+	if evl.opts.tlsConfig != nil {
+		tlsConnection, err := newTLSConnection(evl.ctx, connection, tls.Server(&tlsTransport{connection: connection}, evl.opts.tlsConfig))
+		if err != nil {
+			log.Warnf("[eventloop %s] tls handshake failed: %s", evl.id, err.Error())
+			connection.setCloseReason(err)
+			_ = connection.Close()
+			return
+		}
+		handle = tlsConnection
+	}
+	connection.run(handle)
+}
+
+func (evl *eventLoop) addConnection(connection *connection) bool {
+	evl.mu.Lock()
+	defer evl.mu.Unlock()
+	if atomic.LoadInt32(&evl.closed) != 0 {
+		return false
+	}
+	evl.conns[connection] = struct{}{}
+	atomic.AddUint64(&evl.stats.accepted, 1)
+	return true
+}
+
+func (evl *eventLoop) delConnection(connection *connection) {
+	evl.mu.Lock()
+	delete(evl.conns, connection)
+	evl.mu.Unlock()
+	atomic.AddUint64(&evl.stats.closed, 1)
+}
+
+func (evl *eventLoop) numConnections() int {
+	evl.mu.Lock()
+	defer evl.mu.Unlock()
+	return len(evl.conns)
+}
+
+func (evl *eventLoop) Stats() EventLoopStats {
+	stats := EventLoopStats{
+		Id:           evl.id,
+		Accepted:     atomic.LoadUint64(&evl.stats.accepted),
+		Active:       evl.numConnections(),
+		Closed:       atomic.LoadUint64(&evl.stats.closed),
+		BytesRead:    atomic.LoadUint64(&evl.stats.bytesRead),
+		BytesWritten: atomic.LoadUint64(&evl.stats.bytesWritten),
+	}
+	if evl.stats.latency != nil {
+		stats.Latency = evl.stats.latency.snapshot()
+		stats.Connections = evl.connectionStats()
+	}
+	return stats
+}
+
+func (evl *eventLoop) connectionStats() []ConnectionStats {
+	evl.mu.Lock()
+	stats := make([]ConnectionStats, 0, len(evl.conns))
+	for connection := range evl.conns {
+		stats = append(stats, ConnectionStats{
+			ConnectionID: connection.id,
+			Latency:      connection.latency.snapshot(),
+		})
+	}
+	evl.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ConnectionID < stats[j].ConnectionID })
+	return stats
+}
+
+func (evl *eventLoop) closeConnections() {
+	evl.mu.Lock()
+	conns := make([]*connection, 0, len(evl.conns))
+	for connection := range evl.conns {
+		conns = append(conns, connection)
+	}
+	evl.mu.Unlock()
+	for _, connection := range conns {
+		connection.setCloseReason(ErrEventLoopClosed)
+		_ = connection.Close()
+	}
 }
 
-func (evl *eventLoop) Shutdown(_ context.Context) error {
-	return evl.ln.Close()
+func (evl *eventLoop) submitAccept() {
+	eventData := RingEventData{}
+	eventData.Event = RingPrepAccept
+	eventData.Multishot = evl.multishot
+	evl.operator.Submit(eventData)
+}
+
+func (evl *eventLoop) Shutdown(ctx context.Context) error {
+	evl.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&evl.closed, 0, 1) {
+		evl.mu.Unlock()
+		return nil
+	}
+	ln, fd, done := evl.ln, evl.fd, evl.done
+	pconns := make([]PacketConnection, 0, len(evl.pconns))
+	for connection := range evl.pconns {
+		pconns = append(pconns, connection)
+	}
+	evl.mu.Unlock()
+	// handlers that are running finish their request, the context they
+	// were given is only cancelled if the deadline forces them to stop
+	defer evl.cancel()
+
+	for _, connection := range pconns {
+		_ = connection.Close()
+	}
+
+	if ln != nil {
+		// pending accept requests hold a reference to the listening socket, so
+		// it has to be shut down to make them complete before it is closed
+		_ = syscall.Shutdown(fd, syscall.SHUT_RD)
+		select {
+		case <-done:
+			_ = ln.Close()
+		case <-ctx.Done():
+			// the listener stays open until the accept request completes, but
+			// its socket file must not outlive the shutdown
+			if unixListener, ok := ln.(*net.UnixListener); ok {
+				_ = os.Remove(unixListener.Addr().String())
+			}
+			evl.cancel()
+			evl.closeConnections()
+			return ctx.Err()
+		}
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for evl.numConnections() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			log.Warnf("[eventloop %s] shutdown deadline exceeded, force close %d connections", evl.id, evl.numConnections())
+			evl.cancel()
+			evl.closeConnections()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func listenerFD(ln net.Listener) (int, error) {
+	var rawConn syscall.RawConn
+	var err error
+	switch ln := ln.(type) {
+	case *net.TCPListener:
+		rawConn, err = ln.SyscallConn()
+	case *net.UnixListener:
+		if ln.Addr().Network() != "unix" {
+			return 0, ErrUnsupportedListener
+		}
+		rawConn, err = ln.SyscallConn()
+	default:
+		return 0, ErrUnsupportedListener
+	}
+	if err != nil {
+		return 0, err
+	}
+	fd := 0
+	err = rawConn.Control(func(s uintptr) {
+		fd = int(s)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+func isStaleSocket(path string) bool {
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
 }
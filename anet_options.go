@@ -1,6 +1,7 @@
 package anet
 
 import (
+	"crypto/tls"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -10,7 +11,9 @@ var log *logrus.Logger
 
 func init() {
 	log = logrus.New()
-	RingManager = newDefaultRingManager(4)
+	defaultRingManager = newDefaultRingManager()
+	RingManager = defaultRingManager
+	SetRingManager(defaultRingManager)
 }
 
 func SetLogger(logger *logrus.Logger) {
@@ -33,12 +36,105 @@ func WithWriteTimeout(timeout time.Duration) Option {
 	}
 }
 
+func WithIdleTimeout(timeout time.Duration) Option {
+	return Option{
+		f: func(op *options) {
+			op.idleTimeout = timeout
+		},
+	}
+}
+
+func WithKeepAlive(period time.Duration) Option {
+	return Option{
+		f: func(op *options) {
+			op.keepAlive = period
+		},
+	}
+}
+
+// WithMultishotRecv keeps one multishot receive armed per connection, it
+// takes effect on rings created with WithProvidedBuffers.
+func WithMultishotRecv() Option {
+	return Option{
+		f: func(op *options) {
+			op.multishotRecv = true
+		},
+	}
+}
+
+func WithBufferPool(pool BufferPool) Option {
+	return Option{
+		f: func(op *options) {
+			op.bufferPool = pool
+		},
+	}
+}
+
+func WithTLSConfig(config *tls.Config) Option {
+	return Option{
+		f: func(op *options) {
+			op.tlsConfig = config
+		},
+	}
+}
+
+func WithOnPacket(onPacket OnPacket) Option {
+	return Option{
+		f: func(op *options) {
+			op.onPacket = onPacket
+		},
+	}
+}
+
+func WithOnAcceptError(onAcceptError OnAcceptError) Option {
+	return Option{
+		f: func(op *options) {
+			op.onAcceptError = onAcceptError
+		},
+	}
+}
+
+// WithObserver reports the events of the connections accepted by the event
+// loop to observer.
+func WithObserver(observer Observer) Option {
+	return Option{
+		f: func(op *options) {
+			op.observer = observer
+		},
+	}
+}
+
+// WithLatencyHistogram times every call of OnRequest and reports the times
+// for every open connection in EventLoopStats.Connections and for all of them
+// in EventLoopStats.Latency, counted into buckets with the given upper bounds.
+// DefaultLatencyBuckets is used if none are given.
+func WithLatencyHistogram(buckets ...time.Duration) Option {
+	return Option{
+		f: func(op *options) {
+			if len(buckets) == 0 {
+				buckets = DefaultLatencyBuckets
+			}
+			op.latencyBuckets = buckets
+		},
+	}
+}
+
 type Option struct {
 	f func(*options)
 }
 
 type options struct {
-	onRequest    OnRequest
-	readTimeout  time.Duration
-	writeTimeout time.Duration
+	onRequest     OnRequest
+	onPacket      OnPacket
+	onAcceptError OnAcceptError
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	idleTimeout   time.Duration
+	keepAlive     time.Duration
+	tlsConfig     *tls.Config
+	bufferPool    BufferPool
+	multishotRecv bool
+	// upper bounds of the latency histogram, none if requests are not timed
+	latencyBuckets []time.Duration
+	observer       Observer
 }
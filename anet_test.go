@@ -0,0 +1,215 @@
+package anet
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedPacketConnection fails its reads with errs in turn and reads a
+// packet once they are used up.
+type scriptedPacketConnection struct {
+	errs  []error
+	reads int
+}
+
+func (c *scriptedPacketConnection) ID() string {
+	return "scripted"
+}
+
+func (c *scriptedPacketConnection) LocalAddr() net.Addr {
+	return nil
+}
+
+func (c *scriptedPacketConnection) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.reads++
+	if len(c.errs) == 0 {
+		return copy(p, "packet"), &net.UDPAddr{}, nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return 0, nil, err
+}
+
+func (c *scriptedPacketConnection) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+func (c *scriptedPacketConnection) Close() error {
+	return nil
+}
+
+func TestServePacketErrors(t *testing.T) {
+	packets := 0
+	errStop := errors.New("stop")
+	evl, err := NewEventLoop(nil, WithOnPacket(func(ctx context.Context, connection PacketConnection, data []byte, addr net.Addr) error {
+		packets++
+		return errStop
+	}))
+	require.NoError(t, err)
+
+	// errors of earlier packets are skipped, a lack of memory is waited out
+	// and closing ends the loop without an error
+	connection := &scriptedPacketConnection{errs: []error{syscall.ECONNREFUSED, syscall.ENOBUFS, syscall.ENOMEM, ErrConnClosed}}
+	start := time.Now()
+	require.NoError(t, evl.ServePacket(connection))
+	require.GreaterOrEqual(t, time.Since(start), minRetryBackoff+2*minRetryBackoff)
+	require.Equal(t, 4, connection.reads)
+	require.Zero(t, packets)
+
+	// any other error stops serving
+	connection = &scriptedPacketConnection{errs: []error{syscall.EBADF}}
+	require.ErrorIs(t, evl.ServePacket(connection), syscall.EBADF)
+
+	// as does an error of the handler
+	connection = &scriptedPacketConnection{}
+	require.ErrorIs(t, evl.ServePacket(connection), errStop)
+	require.Equal(t, 1, packets)
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var acceptErrs []error
+	_, addr := serveLoop(t, handleEcho, WithOnAcceptError(func(err error) {
+		mu.Lock()
+		acceptErrs = append(acceptErrs, err)
+		mu.Unlock()
+	}))
+
+	// the process runs out of fds except for the one the client takes, so
+	// the connection waits in the backlog while accepting it fails
+	var limit syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit))
+	entries, err := os.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+	highest := 0
+	for _, entry := range entries {
+		fd, _ := strconv.Atoi(entry.Name())
+		highest = max(highest, fd)
+	}
+	lowered := limit
+	lowered.Cur = uint64(highest) + 64
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered))
+	defer func() {
+		_ = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+	}()
+	var fillers []int
+	closeFillers := func() {
+		for _, fd := range fillers {
+			_ = syscall.Close(fd)
+		}
+		fillers = nil
+	}
+	defer closeFillers()
+	for {
+		fd, err := syscall.Dup(0)
+		if err != nil {
+			require.ErrorIs(t, err, syscall.EMFILE)
+			break
+		}
+		fillers = append(fillers, fd)
+	}
+	_ = syscall.Close(fillers[len(fillers)-1])
+	fillers = fillers[:len(fillers)-1]
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// accepts are retried with a growing delay instead of spinning, about
+	// six times in the first 300ms
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	failed := len(acceptErrs)
+	for _, err := range acceptErrs {
+		require.ErrorIs(t, err, syscall.EMFILE)
+	}
+	mu.Unlock()
+	require.GreaterOrEqual(t, failed, 1)
+	require.LessOrEqual(t, failed, 10)
+
+	// the waiting connection is served once fds are free again
+	closeFillers()
+	message := GetRandomString(47) + "\n"
+	_, err = conn.Write([]byte(message))
+	require.NoError(t, err)
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, message, response)
+}
+
+// serveLoop serves onRequest on a free loopback port until the test ends and
+// returns the event loop with the address it listens on.
+func serveLoop(t *testing.T, onRequest OnRequest, ops ...Option) (EventLoop, string) {
+	listener, err := CreateListener("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	eventLoop, err := NewEventLoop(onRequest, ops...)
+	require.NoError(t, err)
+	go func() {
+		_ = eventLoop.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = eventLoop.Shutdown(context.Background())
+		_ = listener.Close()
+	})
+	return eventLoop, listener.Addr().String()
+}
+
+// handleEcho writes every line it reads back to the connection.
+func handleEcho(_ context.Context, connection Connection) error {
+	reader, writer := connection.Reader(), connection.Writer()
+	for {
+		data, err := reader.ReadUtil('\n')
+		if err != nil {
+			return err
+		}
+		err = writer.WriteBytes(data, len(data))
+		if err != nil {
+			return err
+		}
+		err = writer.Flush()
+		if err != nil {
+			return err
+		}
+		reader.Release()
+	}
+}
+
+// handleMessage echoes a single line per call.
+func handleMessage(_ context.Context, connection Connection) error {
+	reader, writer := connection.Reader(), connection.Writer()
+	data, err := reader.ReadUtil('\n')
+	if err != nil {
+		return err
+	}
+	err = writer.WriteBytes(data, len(data))
+	if err != nil {
+		return err
+	}
+	reader.Release()
+	return writer.Flush()
+}
+
+// echo sends m lines of messageLength bytes over connection, which is served
+// by handleEcho, and checks that each of them comes back.
+func echo(t *testing.T, connection Connection, m, messageLength int) {
+	t.Helper()
+	reader, writer := connection.Reader(), connection.Writer()
+	for i := 0; i < m; i++ {
+		message := GetRandomString(messageLength-1) + "\n"
+		require.NoError(t, writer.WriteString(message, len(message)))
+		require.NoError(t, writer.Flush())
+		response, err := reader.ReadUtil('\n')
+		require.NoError(t, err)
+		require.Equal(t, message, string(response))
+		reader.Release()
+	}
+}
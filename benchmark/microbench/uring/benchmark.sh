@@ -0,0 +1,6 @@
+#!/usr/bin/env bash
+
+echo "liburing backend"
+go test -bench=.
+echo "pure go backend"
+go test -tags anet_purego -bench=.
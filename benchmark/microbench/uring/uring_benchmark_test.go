@@ -0,0 +1,102 @@
+package uring
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zjregee/anet"
+)
+
+func newOperator(b *testing.B, done chan struct{}) (*anet.FDOperator, *os.File) {
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ring := anet.GetRingManager().Pick(nil)
+	op := ring.Alloc()
+	op.FD = int(f.Fd())
+	op.Ring = ring
+	op.OnWrite = func(n int, err error) {
+		done <- struct{}{}
+	}
+	op.Register()
+	return op, f
+}
+
+// reportPerSQE adds the time spent per submission queue entry and the entries
+// per submission, so that both backends can be compared entry by entry.
+func reportPerSQE(b *testing.B, ring anet.Ring, start anet.RingStats) {
+	elapsed := b.Elapsed()
+	stats := ring.Stats()
+	sqes := stats.Submitted - start.Submitted
+	batches := stats.Batches - start.Batches
+	if sqes == 0 || batches == 0 {
+		return
+	}
+	b.ReportMetric(float64(elapsed.Nanoseconds())/float64(sqes), "ns/sqe")
+	b.ReportMetric(float64(sqes)/float64(batches), "sqes/batch")
+}
+
+func BenchmarkRingWrite(b *testing.B) {
+	done := make(chan struct{}, 1)
+	op, f := newOperator(b, done)
+	defer f.Close()
+	defer op.Free()
+	data := make([]byte, 64)
+	start := op.Ring.Stats()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		op.Submit(anet.RingEventData{Size: len(data), Data: data, Event: anet.RingPrepWrite})
+		<-done
+	}
+	reportPerSQE(b, op.Ring, start)
+}
+
+func BenchmarkRingWriteBatch(b *testing.B) {
+	const batch = 32
+	done := make(chan struct{}, batch)
+	op, f := newOperator(b, done)
+	defer f.Close()
+	defer op.Free()
+	data := make([]byte, 64)
+	start := op.Ring.Stats()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += batch {
+		for j := 0; j < batch; j++ {
+			op.Submit(anet.RingEventData{Size: len(data), Data: data, Event: anet.RingPrepWrite})
+		}
+		for j := 0; j < batch; j++ {
+			<-done
+		}
+	}
+	reportPerSQE(b, op.Ring, start)
+}
+
+// BenchmarkRingWriteTimeout submits two entries per write, the write and its
+// linked timeout.
+func BenchmarkRingWriteTimeout(b *testing.B) {
+	const batch = 32
+	done := make(chan struct{}, batch)
+	op, f := newOperator(b, done)
+	defer f.Close()
+	defer op.Free()
+	data := make([]byte, 64)
+	start := op.Ring.Stats()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += batch {
+		for j := 0; j < batch; j++ {
+			op.Submit(anet.RingEventData{Size: len(data), Data: data, Event: anet.RingPrepWrite, Timeout: time.Second})
+		}
+		for j := 0; j < batch; j++ {
+			<-done
+		}
+	}
+	reportPerSQE(b, op.Ring, start)
+}
@@ -29,7 +29,7 @@ func (c *connection) init(conn net.Conn) {
 	c.file = file
 	c.conn = conn
 
-	ring := anet.RingManager.Pick()
+	ring := anet.GetRingManager().Pick(nil)
 	op := ring.Alloc()
 	op.FD = c.fd
 	op.OnRead = c.onRead
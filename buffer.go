@@ -1,5 +1,7 @@
 package anet
 
+import "bytes"
+
 type Reader interface {
 	Seek(n int) ([]byte, error)
 	SeekAck(n int) error
@@ -8,6 +10,7 @@ type Reader interface {
 	ReadUtil(delim byte) ([]byte, error)
 	ReadBytes(n int) ([]byte, error)
 	ReadString(n int) (string, error)
+	Slice(n int) (Reader, error)
 	Len() int
 	Release()
 }
@@ -17,6 +20,7 @@ type Writer interface {
 	BookAck(n int) error
 	WriteBytes(data []byte, n int) error
 	WriteString(data string, n int) error
+	WriteDirect(p []byte) error
 	Flush() error
 }
 
@@ -24,3 +28,19 @@ type ReadWriter interface {
 	Reader
 	Writer
 }
+
+// indexByte returns the offset of the first delim in the unread data of
+// buffer at or after from, or -1 and the length of the data it has scanned,
+// where the next search can pick up.
+func indexByte(buffer Reader, delim byte, from int) (int, int) {
+	if b, ok := buffer.(interface {
+		indexByte(delim byte, from int) (int, int)
+	}); ok {
+		return b.indexByte(delim, from)
+	}
+	data, _ := buffer.SeekAll()
+	if i := bytes.IndexByte(data[from:], delim); i >= 0 {
+		return from + i, len(data)
+	}
+	return -1, len(data)
+}
@@ -74,6 +74,16 @@ func (b *bytesBuffer) ReadString(n int) (string, error) {
 	return string(data), nil
 }
 
+func (b *bytesBuffer) Slice(n int) (Reader, error) {
+	data, err := b.ReadBytes(n)
+	if err != nil {
+		return nil, err
+	}
+	slice := NewBytesBuffer(n)
+	_ = slice.WriteBytes(data, n)
+	return slice, nil
+}
+
 func (b *bytesBuffer) Len() int {
 	return b.end - b.start
 }
@@ -124,6 +134,10 @@ func (b *bytesBuffer) WriteString(data string, n int) error {
 	return nil
 }
 
+func (b *bytesBuffer) WriteDirect(p []byte) error {
+	return b.WriteBytes(p, len(p))
+}
+
 func (b *bytesBuffer) Flush() error {
 	panic("unreachable code")
 }
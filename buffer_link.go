@@ -0,0 +1,378 @@
+package anet
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+)
+
+const (
+	defaultLinkBlockSize = 4096
+	maxReleasedBlocks    = 16
+	maxWriteChunks       = 1024
+)
+
+func NewLinkBuffer(blockSize int) ReadWriter {
+	return NewPooledLinkBuffer(blockSize, nil)
+}
+
+// NewPooledLinkBuffer creates a link buffer whose blocks are taken from pool
+// and handed back once they are drained and released. A nil pool falls back
+// to plain allocations.
+func NewPooledLinkBuffer(blockSize int, pool BufferPool) ReadWriter {
+	if blockSize <= 0 {
+		blockSize = defaultLinkBlockSize
+	}
+	return &linkBuffer{
+		blockSize: blockSize,
+		pool:      pool,
+	}
+}
+
+type linkBlock struct {
+	buf    []byte
+	off    int
+	end    int
+	next   *linkBlock
+	refs   int32
+	pooled bool
+	parent *linkBlock
+	// direct blocks reference memory of the caller and are never written to
+	direct bool
+}
+
+func (b *linkBlock) remain() int {
+	if b.direct {
+		return 0
+	}
+	return len(b.buf) - b.end
+}
+
+func (b *linkBlock) unread() int {
+	return b.end - b.off
+}
+
+// linkBuffer keeps data in a singly linked list of fixed size blocks. Reads
+// that fall inside one block are served without copying and blocks that have
+// been read to the end are unlinked as soon as the read pointer leaves them.
+type linkBuffer struct {
+	head     *linkBlock
+	tail     *linkBlock
+	released []*linkBlock
+	// booked is pinned from Book until BookAck, the kernel may still write
+	// into it after the buffer has been released or recycled
+	booked    *linkBlock
+	length    int
+	blockSize int
+	pool      BufferPool
+}
+
+var _ Reader = &linkBuffer{}
+var _ Writer = &linkBuffer{}
+var _ ReadWriter = &linkBuffer{}
+
+func (b *linkBuffer) Seek(n int) ([]byte, error) {
+	if b.length < n {
+		return nil, errors.New("not enough data in buffer")
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if b.head.unread() >= n {
+		return b.head.buf[b.head.off : b.head.off+n], nil
+	}
+	data := make([]byte, n)
+	offset := 0
+	for block := b.head; offset < n; block = block.next {
+		offset += copy(data[offset:], block.buf[block.off:block.end])
+	}
+	return data, nil
+}
+
+func (b *linkBuffer) SeekAck(n int) error {
+	if b.length < n {
+		return errors.New("not enough data in buffer")
+	}
+	b.consume(n)
+	return nil
+}
+
+func (b *linkBuffer) SeekAll() ([]byte, error) {
+	return b.Seek(b.length)
+}
+
+func (b *linkBuffer) ReadAll() ([]byte, error) {
+	return b.ReadBytes(b.length)
+}
+
+func (b *linkBuffer) ReadUtil(delim byte) ([]byte, error) {
+	panic("unreachable code")
+}
+
+func (b *linkBuffer) ReadBytes(n int) ([]byte, error) {
+	data, err := b.Seek(n)
+	if err != nil {
+		return nil, err
+	}
+	b.consume(n)
+	return data, nil
+}
+
+func (b *linkBuffer) ReadString(n int) (string, error) {
+	data, err := b.ReadBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (b *linkBuffer) Slice(n int) (Reader, error) {
+	if b.length < n {
+		return nil, errors.New("not enough data in buffer")
+	}
+	slice := &linkBuffer{blockSize: b.blockSize, pool: b.pool}
+	for n > 0 {
+		size := b.head.unread()
+		if size > n {
+			size = n
+		}
+		// the shared region is capped so that writes into the slice never
+		// touch the memory still owned by this buffer
+		buf := b.head.buf[b.head.off : b.head.off+size : b.head.off+size]
+		block := &linkBlock{buf: buf, end: size}
+		if owner := b.head.owner(); owner != nil {
+			atomic.AddInt32(&owner.refs, 1)
+			block.parent = owner
+		}
+		slice.append(block)
+		slice.length += size
+		b.consume(size)
+		n -= size
+	}
+	return slice, nil
+}
+
+// indexByte scans the unread data block by block without merging blocks.
+func (b *linkBuffer) indexByte(delim byte, from int) (int, int) {
+	offset := 0
+	for block := b.head; block != nil; block = block.next {
+		data := block.buf[block.off:block.end]
+		if start := from - offset; start < len(data) {
+			if start < 0 {
+				start = 0
+			}
+			if i := bytes.IndexByte(data[start:], delim); i >= 0 {
+				return offset + start + i, offset + start + i
+			}
+		}
+		offset += len(data)
+	}
+	return -1, offset
+}
+
+func (b *linkBuffer) Len() int {
+	return b.length
+}
+
+func (b *linkBuffer) Release() {
+	for i, block := range b.released {
+		b.free(block)
+		b.released[i] = nil
+	}
+	b.released = b.released[:0]
+	if b.length == 0 && b.tail != nil && b.tail != b.booked {
+		if b.pool != nil || b.tail.direct {
+			// a drained buffer holds no memory at all until it is written again
+			b.free(b.tail)
+			b.head = nil
+			b.tail = nil
+			return
+		}
+		b.head = b.tail
+		b.tail.off = 0
+		b.tail.end = 0
+	}
+}
+
+// recycle hands every block back to the pool, the buffer must not be used
+// afterwards.
+func (b *linkBuffer) recycle() {
+	for block := b.head; block != nil; block = block.next {
+		b.free(block)
+	}
+	for _, block := range b.released {
+		b.free(block)
+	}
+	b.head = nil
+	b.tail = nil
+	b.released = nil
+	b.length = 0
+}
+
+func (b *linkBuffer) Book(n int) []byte {
+	if b.tail == nil || b.tail.remain() < n {
+		b.grow(n)
+	}
+	if b.booked != b.tail {
+		// a new booking takes over from one that was never acked
+		b.unpin()
+		if owner := b.tail.owner(); owner != nil {
+			atomic.AddInt32(&owner.refs, 1)
+		}
+		b.booked = b.tail
+	}
+	return b.tail.buf[b.tail.end : b.tail.end+n]
+}
+
+func (b *linkBuffer) BookAck(n int) error {
+	booked := b.booked
+	b.unpin()
+	// the booked block is gone if the buffer has been recycled meanwhile
+	if b.tail == nil || booked != nil && booked != b.tail || b.tail.remain() < n {
+		return errors.New("not enough space in buffer")
+	}
+	b.tail.end += n
+	b.length += n
+	return nil
+}
+
+func (b *linkBuffer) WriteBytes(data []byte, n int) error {
+	data = data[:n]
+	for len(data) > 0 {
+		if b.tail == nil || b.tail.remain() == 0 {
+			b.grow(len(data))
+		}
+		k := copy(b.tail.buf[b.tail.end:], data)
+		b.tail.end += k
+		b.length += k
+		data = data[k:]
+	}
+	return nil
+}
+
+func (b *linkBuffer) WriteString(data string, n int) error {
+	data = data[:n]
+	for len(data) > 0 {
+		if b.tail == nil || b.tail.remain() == 0 {
+			b.grow(len(data))
+		}
+		k := copy(b.tail.buf[b.tail.end:], data)
+		b.tail.end += k
+		b.length += k
+		data = data[k:]
+	}
+	return nil
+}
+
+// WriteDirect links p into the buffer without copying it, so p must not be
+// modified until it has been read out of the buffer.
+func (b *linkBuffer) WriteDirect(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	b.append(&linkBlock{buf: p[:len(p):len(p)], end: len(p), direct: true})
+	b.length += len(p)
+	return nil
+}
+
+// chunks returns at most max slices which cover the unread data in order,
+// without copying it.
+func (b *linkBuffer) chunks(max int) [][]byte {
+	var chunks [][]byte
+	for block := b.head; block != nil && len(chunks) < max; block = block.next {
+		if block.unread() > 0 {
+			chunks = append(chunks, block.buf[block.off:block.end])
+		}
+	}
+	return chunks
+}
+
+func (b *linkBuffer) Flush() error {
+	panic("unreachable code")
+}
+
+func (b *linkBuffer) grow(n int) {
+	size := b.blockSize
+	if size < n {
+		size = n
+	}
+	if b.pool == nil {
+		b.append(&linkBlock{buf: make([]byte, size)})
+		return
+	}
+	b.append(&linkBlock{buf: b.pool.Get(size), refs: 1, pooled: true})
+}
+
+func (b *linkBuffer) append(block *linkBlock) {
+	if b.tail == nil {
+		b.head = block
+		b.tail = block
+		return
+	}
+	if b.head == b.tail && b.tail.unread() == 0 {
+		// nothing is left to read, so the drained block can go at once
+		b.retire(b.tail)
+		b.head = block
+		b.tail = block
+		return
+	}
+	b.tail.next = block
+	b.tail = block
+}
+
+func (b *linkBuffer) consume(n int) {
+	for n > 0 {
+		size := b.head.unread()
+		if size > n {
+			b.head.off += n
+			b.length -= n
+			return
+		}
+		b.head.off += size
+		b.length -= size
+		n -= size
+		if b.head != b.tail {
+			block := b.head
+			b.head = block.next
+			block.next = nil
+			b.retire(block)
+		}
+	}
+}
+
+// retire parks a drained block until the next Release, since slices handed
+// out by earlier reads may still point into it.
+func (b *linkBuffer) retire(block *linkBlock) {
+	if b.pool == nil || block.owner() == nil || len(b.released) >= maxReleasedBlocks {
+		return
+	}
+	b.released = append(b.released, block)
+}
+
+func (b *linkBuffer) unpin() {
+	if b.booked == nil {
+		return
+	}
+	b.free(b.booked)
+	b.booked = nil
+}
+
+func (b *linkBuffer) free(block *linkBlock) {
+	owner := block.owner()
+	if b.pool == nil || owner == nil {
+		return
+	}
+	if atomic.AddInt32(&owner.refs, -1) == 0 {
+		b.pool.Put(owner.buf)
+	}
+}
+
+func (b *linkBlock) owner() *linkBlock {
+	if b.parent != nil {
+		return b.parent
+	}
+	if b.pooled {
+		return b
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package anet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkBufferReadWithinBlock(t *testing.T) {
+	b := NewLinkBuffer(16).(*linkBuffer)
+	require.NoError(t, b.WriteString("hello world", 11))
+
+	// a read that fits in one block points into the block itself
+	data, err := b.ReadBytes(5)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	require.Same(t, &b.head.buf[0], &data[0])
+	require.Equal(t, 6, b.Len())
+
+	_, err = b.Seek(7)
+	require.Error(t, err)
+	require.Error(t, b.SeekAck(7))
+	rest, err := b.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, " world", string(rest))
+	require.Equal(t, 0, b.Len())
+}
+
+func TestLinkBufferReadAcrossBlocks(t *testing.T) {
+	b := NewLinkBuffer(4).(*linkBuffer)
+	for _, s := range []string{"hel", "lo w", "orld"} {
+		require.NoError(t, b.WriteString(s, len(s)))
+	}
+	require.Equal(t, 11, b.Len())
+	require.Len(t, b.chunks(maxWriteChunks), 3)
+
+	peek, err := b.Seek(6)
+	require.NoError(t, err)
+	require.Equal(t, "hello ", string(peek))
+	require.Equal(t, 11, b.Len())
+
+	require.NoError(t, b.SeekAck(2))
+	data, err := b.ReadString(9)
+	require.NoError(t, err)
+	require.Equal(t, "llo world", data)
+	// every block but the last is unlinked once it has been read through
+	require.Same(t, b.head, b.tail)
+}
+
+func TestLinkBufferBook(t *testing.T) {
+	b := NewLinkBuffer(8).(*linkBuffer)
+	buf := b.Book(4)
+	require.Len(t, buf, 4)
+	copy(buf, "abcd")
+	require.NoError(t, b.BookAck(4))
+	require.Equal(t, 4, b.Len())
+	require.Error(t, b.BookAck(5))
+
+	// a booking larger than the block size gets a block of its own
+	large := b.Book(32)
+	require.Len(t, large, 32)
+	require.NotSame(t, b.head, b.tail)
+	copy(large, "efgh")
+	require.NoError(t, b.BookAck(4))
+	data, err := b.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "abcdefgh", string(data))
+}
+
+func TestLinkBufferWriteDirect(t *testing.T) {
+	b := NewLinkBuffer(8).(*linkBuffer)
+	require.NoError(t, b.WriteString("ab", 2))
+	p := []byte("direct")
+	require.NoError(t, b.WriteDirect(p))
+	require.NoError(t, b.WriteString("cd", 2))
+
+	chunks := b.chunks(maxWriteChunks)
+	require.Len(t, chunks, 3)
+	require.Same(t, &p[0], &chunks[1][0])
+	data, err := b.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "abdirectcd", string(data))
+}
+
+func TestLinkBufferReleaseReusesDrainedBlock(t *testing.T) {
+	b := NewLinkBuffer(8).(*linkBuffer)
+	require.NoError(t, b.WriteString("abcd", 4))
+	block := b.tail
+	_, err := b.ReadAll()
+	require.NoError(t, err)
+	b.Release()
+
+	require.NoError(t, b.WriteString("efgh", 4))
+	require.Same(t, block, b.tail)
+	require.Equal(t, 0, block.off)
+	require.Equal(t, 4, block.end)
+}
+
+func TestLinkBufferSlice(t *testing.T) {
+	b := NewLinkBuffer(16).(*linkBuffer)
+	require.NoError(t, b.WriteString("0123456789", 10))
+
+	_, err := b.Slice(11)
+	require.Error(t, err)
+	r, err := b.Slice(6)
+	require.NoError(t, err)
+	require.Equal(t, 6, r.Len())
+	require.Equal(t, 4, b.Len())
+
+	// the slice shares the memory of the buffer instead of copying it
+	head, err := r.Seek(6)
+	require.NoError(t, err)
+	require.Equal(t, "012345", string(head))
+	require.Same(t, &b.head.buf[0], &head[0])
+
+	// but writes into the slice never reach the data left in the buffer
+	slice := r.(*linkBuffer)
+	require.NoError(t, slice.WriteString("xyz", 3))
+	rest, err := b.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "6789", string(rest))
+	data, err := slice.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "012345xyz", string(data))
+}
+
+func TestLinkBufferReturnsConsumedBlocksToPool(t *testing.T) {
+	pool := NewSizeClassBufferPool(8, 1024, 16)
+	b := NewPooledLinkBuffer(8, pool).(*linkBuffer)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, b.WriteString("01234567", 8))
+	}
+	require.Equal(t, uint64(4), pool.Stats().Allocated)
+
+	_, err := b.ReadBytes(20)
+	require.NoError(t, err)
+	// drained blocks are only handed back on Release, slices of earlier reads
+	// may still point into them
+	require.Equal(t, uint64(0), pool.Stats().Released)
+	b.Release()
+	require.Equal(t, uint64(2), pool.Stats().Released)
+
+	_, err = b.ReadAll()
+	require.NoError(t, err)
+	b.Release()
+	require.Equal(t, uint64(4), pool.Stats().Released)
+	require.Nil(t, b.head)
+
+	// the buffer takes blocks from the pool again once it is written to
+	require.NoError(t, b.WriteString("again", 5))
+	require.Equal(t, uint64(1), pool.Stats().Reused)
+}
+
+func TestLinkBufferSliceOfPooledBlocks(t *testing.T) {
+	pool := NewSizeClassBufferPool(8, 1024, 16)
+	b := NewPooledLinkBuffer(8, pool).(*linkBuffer)
+	require.NoError(t, b.WriteString("0123456789", 10))
+	r, err := b.Slice(6)
+	require.NoError(t, err)
+	slice := r.(*linkBuffer)
+	_, err = b.ReadAll()
+	require.NoError(t, err)
+
+	// a block goes back to the pool only once neither of them references it
+	b.Release()
+	require.Nil(t, b.head)
+	require.Equal(t, uint64(0), pool.Stats().Released)
+	data, err := slice.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "012345", string(data))
+	slice.Release()
+	require.Equal(t, uint64(1), pool.Stats().Released)
+}
+
+func TestLinkBufferRecycle(t *testing.T) {
+	pool := NewSizeClassBufferPool(8, 1024, 16)
+	b := NewPooledLinkBuffer(8, pool).(*linkBuffer)
+	require.NoError(t, b.WriteString("01234567", 8))
+	require.NoError(t, b.WriteString("89abcdef", 8))
+	_, err := b.ReadBytes(9)
+	require.NoError(t, err)
+
+	// unread and retired blocks alike go back to the pool
+	b.recycle()
+	require.Equal(t, uint64(2), pool.Stats().Released)
+	require.Equal(t, 0, b.Len())
+	require.Nil(t, b.head)
+}
+
+func TestLinkBufferPinsBookedBlock(t *testing.T) {
+	pool := NewSizeClassBufferPool(8, 1024, 16)
+	b := NewPooledLinkBuffer(8, pool).(*linkBuffer)
+	buf := b.Book(4)
+
+	// the booked space may still be written to after the buffer let go of it
+	b.Release()
+	require.Equal(t, uint64(0), pool.Stats().Released)
+	copy(buf, "abcd")
+	require.NoError(t, b.BookAck(4))
+	data, err := b.ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "abcd", string(data))
+
+	// a recycled buffer drops the booking, its block goes back once acked
+	b.Book(4)
+	b.recycle()
+	require.Equal(t, uint64(0), pool.Stats().Released)
+	require.Error(t, b.BookAck(4))
+	require.Equal(t, uint64(1), pool.Stats().Released)
+}
+
+func TestLinkBufferIndexByte(t *testing.T) {
+	b := NewLinkBuffer(4).(*linkBuffer)
+	for _, s := range []string{"ab", "cd\nef", "gh"} {
+		require.NoError(t, b.WriteString(s, len(s)))
+	}
+	require.NoError(t, b.SeekAck(1))
+
+	index, _ := indexByte(b, '\n', 0)
+	require.Equal(t, 3, index)
+	// a search resumes where the last one stopped
+	index, _ = indexByte(b, '\n', 4)
+	require.Equal(t, -1, index)
+	index, scanned := indexByte(b, 'x', 2)
+	require.Equal(t, -1, index)
+	require.Equal(t, b.Len(), scanned)
+	require.NoError(t, b.WriteString("x", 1))
+	index, _ = indexByte(b, 'x', scanned)
+	require.Equal(t, 8, index)
+
+	data, err := b.ReadBytes(4)
+	require.NoError(t, err)
+	require.Equal(t, "bcd\n", string(data))
+}
@@ -0,0 +1,124 @@
+package anet
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultPoolMinSize   = 1 << 10
+	defaultPoolMaxSize   = 1 << 20
+	defaultPoolClassIdle = 1024
+)
+
+var DefaultBufferPool BufferPool = NewSizeClassBufferPool(defaultPoolMinSize, defaultPoolMaxSize, defaultPoolClassIdle)
+
+type BufferPool interface {
+	// Get returns a buffer whose length is at least size.
+	Get(size int) []byte
+	Put(buf []byte)
+	Stats() BufferPoolStats
+}
+
+type BufferPoolStats struct {
+	Allocated uint64
+	Reused    uint64
+	Released  uint64
+	Dropped   uint64
+}
+
+// NewSizeClassBufferPool creates a pool that rounds requests up to a power of
+// two between minSize and maxSize and keeps at most maxIdle free buffers in
+// every size class. Larger requests are served by plain allocations.
+func NewSizeClassBufferPool(minSize, maxSize, maxIdle int) BufferPool {
+	if minSize <= 0 {
+		minSize = defaultPoolMinSize
+	}
+	if maxSize < minSize {
+		maxSize = minSize
+	}
+	pool := &sizeClassPool{
+		minShift: bits.Len(uint(minSize - 1)),
+		maxIdle:  maxIdle,
+	}
+	maxShift := bits.Len(uint(maxSize - 1))
+	pool.classes = make([]sizeClass, maxShift-pool.minShift+1)
+	for i := range pool.classes {
+		pool.classes[i].size = 1 << (pool.minShift + i)
+	}
+	return pool
+}
+
+type sizeClass struct {
+	size int
+	free [][]byte
+	mu   sync.Mutex
+}
+
+type sizeClassPool struct {
+	classes   []sizeClass
+	minShift  int
+	maxIdle   int
+	allocated uint64
+	reused    uint64
+	released  uint64
+	dropped   uint64
+}
+
+func (p *sizeClassPool) Get(size int) []byte {
+	class := p.class(size)
+	if class == nil {
+		atomic.AddUint64(&p.allocated, 1)
+		return make([]byte, size)
+	}
+	class.mu.Lock()
+	if n := len(class.free); n > 0 {
+		buf := class.free[n-1]
+		class.free[n-1] = nil
+		class.free = class.free[:n-1]
+		class.mu.Unlock()
+		atomic.AddUint64(&p.reused, 1)
+		return buf[:class.size]
+	}
+	class.mu.Unlock()
+	atomic.AddUint64(&p.allocated, 1)
+	return make([]byte, class.size)
+}
+
+func (p *sizeClassPool) Put(buf []byte) {
+	class := p.class(cap(buf))
+	if class == nil || class.size != cap(buf) {
+		atomic.AddUint64(&p.dropped, 1)
+		return
+	}
+	class.mu.Lock()
+	if len(class.free) >= p.maxIdle {
+		class.mu.Unlock()
+		atomic.AddUint64(&p.dropped, 1)
+		return
+	}
+	class.free = append(class.free, buf[:cap(buf)])
+	class.mu.Unlock()
+	atomic.AddUint64(&p.released, 1)
+}
+
+func (p *sizeClassPool) Stats() BufferPoolStats {
+	return BufferPoolStats{
+		Allocated: atomic.LoadUint64(&p.allocated),
+		Reused:    atomic.LoadUint64(&p.reused),
+		Released:  atomic.LoadUint64(&p.released),
+		Dropped:   atomic.LoadUint64(&p.dropped),
+	}
+}
+
+func (p *sizeClassPool) class(size int) *sizeClass {
+	index := bits.Len(uint(size-1)) - p.minShift
+	if size <= 0 || index < 0 {
+		index = 0
+	}
+	if index >= len(p.classes) {
+		return nil
+	}
+	return &p.classes[index]
+}
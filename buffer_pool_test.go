@@ -0,0 +1,108 @@
+package anet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeClassPoolReuse(t *testing.T) {
+	pool := NewSizeClassBufferPool(1024, 1<<20, 2)
+	buf := pool.Get(1000)
+	require.Len(t, buf, 1024)
+	pool.Put(buf[:10])
+
+	// a request of the same class gets the released buffer back whole
+	reused := pool.Get(700)
+	require.Len(t, reused, 1024)
+	require.Same(t, &buf[0], &reused[0])
+	require.Equal(t, BufferPoolStats{Allocated: 1, Reused: 1, Released: 1}, pool.Stats())
+
+	// a class keeps at most maxIdle free buffers
+	for i := 0; i < 3; i++ {
+		pool.Put(make([]byte, 1024))
+	}
+	require.Equal(t, BufferPoolStats{Allocated: 1, Reused: 1, Released: 3, Dropped: 1}, pool.Stats())
+}
+
+func TestSizeClassPoolBoundaries(t *testing.T) {
+	pool := NewSizeClassBufferPool(1000, 1<<20, 16)
+	for _, c := range []struct {
+		size   int
+		length int
+	}{
+		{0, 1024},
+		{1, 1024},
+		{1024, 1024},
+		{1025, 2048},
+		{4096, 4096},
+		{4097, 8192},
+		{1 << 20, 1 << 20},
+		// beyond the largest class the request is allocated as is
+		{1<<20 + 1, 1<<20 + 1},
+	} {
+		buf := pool.Get(c.size)
+		require.Len(t, buf, c.length, "size %d", c.size)
+		require.Equal(t, c.length, cap(buf), "size %d", c.size)
+	}
+
+	// only buffers whose capacity is exactly a class size are taken back
+	stats := pool.Stats()
+	pool.Put(make([]byte, 1500))
+	pool.Put(make([]byte, 1<<21))
+	pool.Put(make([]byte, 2048))
+	require.Equal(t, stats.Dropped+2, pool.Stats().Dropped)
+	require.Equal(t, stats.Released+1, pool.Stats().Released)
+}
+
+func TestDialRecyclesPooledBuffers(t *testing.T) {
+	listener := listenEcho(t)
+	pool := NewSizeClassBufferPool(defaultPoolMinSize, defaultPoolMaxSize, defaultPoolClassIdle)
+	connection, err := Dial("tcp", listener.Addr().String(), WithBufferPool(pool))
+	require.NoError(t, err)
+	message := GetRandomString(100)
+	require.NoError(t, connection.Writer().WriteString(message, len(message)))
+	require.NoError(t, connection.Writer().Flush())
+	// the rest of the echo stays in the input buffer
+	_, err = connection.Reader().ReadBytes(1)
+	require.NoError(t, err)
+	require.NoError(t, connection.Close())
+	connection.Reader().Release()
+
+	// its block comes back once the operator of the closed connection has
+	// drained
+	require.Eventually(t, func() bool {
+		stats := pool.Stats()
+		return stats.Released+stats.Dropped == stats.Allocated+stats.Reused
+	}, time.Second, time.Millisecond)
+}
+
+func TestDialKeepsReadDataAfterClose(t *testing.T) {
+	listener := listenEcho(t)
+	pool := NewSizeClassBufferPool(defaultPoolMinSize, defaultPoolMaxSize, defaultPoolClassIdle)
+	echo := func(message string) (Connection, []byte) {
+		connection, err := Dial("tcp", listener.Addr().String(), WithBufferPool(pool))
+		require.NoError(t, err)
+		require.NoError(t, connection.Writer().WriteString(message, len(message)))
+		require.NoError(t, connection.Writer().Flush())
+		data, err := connection.Reader().ReadBytes(len(message))
+		require.NoError(t, err)
+		return connection, data
+	}
+
+	first, data := echo("first")
+	require.NoError(t, first.Close())
+	// the slice points into a pooled block, which the closed connection
+	// keeps until it is released
+	time.Sleep(10 * time.Millisecond)
+	second, _ := echo("second")
+	defer second.Close()
+	require.Equal(t, "first", string(data))
+
+	released := pool.Stats().Released
+	first.Reader().Release()
+	require.Eventually(t, func() bool {
+		return pool.Stats().Released == released+1
+	}, time.Second, time.Millisecond)
+}
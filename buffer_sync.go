@@ -0,0 +1,126 @@
+package anet
+
+import "sync"
+
+// syncBuffer serializes access to a buffer that the ring appends to while
+// the connection owner reads from it.
+type syncBuffer struct {
+	buffer ReadWriter
+	mu     sync.Mutex
+}
+
+var _ ReadWriter = &syncBuffer{}
+
+func newSyncBuffer(buffer ReadWriter) *syncBuffer {
+	return &syncBuffer{buffer: buffer}
+}
+
+func (b *syncBuffer) Seek(n int) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Seek(n)
+}
+
+func (b *syncBuffer) SeekAck(n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.SeekAck(n)
+}
+
+func (b *syncBuffer) SeekAll() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.SeekAll()
+}
+
+func (b *syncBuffer) ReadAll() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.ReadAll()
+}
+
+func (b *syncBuffer) ReadUtil(delim byte) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.ReadUtil(delim)
+}
+
+func (b *syncBuffer) ReadBytes(n int) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.ReadBytes(n)
+}
+
+func (b *syncBuffer) ReadString(n int) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.ReadString(n)
+}
+
+func (b *syncBuffer) Slice(n int) (Reader, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Slice(n)
+}
+
+func (b *syncBuffer) indexByte(delim byte, from int) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return indexByte(b.buffer, delim, from)
+}
+
+func (b *syncBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Len()
+}
+
+func (b *syncBuffer) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buffer.Release()
+}
+
+func (b *syncBuffer) Book(n int) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Book(n)
+}
+
+func (b *syncBuffer) BookAck(n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.BookAck(n)
+}
+
+func (b *syncBuffer) WriteBytes(data []byte, n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.WriteBytes(data, n)
+}
+
+func (b *syncBuffer) WriteString(data string, n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.WriteString(data, n)
+}
+
+func (b *syncBuffer) WriteDirect(p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.WriteDirect(p)
+}
+
+func (b *syncBuffer) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Flush()
+}
+
+func (b *syncBuffer) recycle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if buffer, ok := b.buffer.(interface{ recycle() }); ok {
+		buffer.recycle()
+	}
+}
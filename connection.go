@@ -1,16 +1,32 @@
 package anet
 
-import "io"
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+)
 
 type CloseCallback func(connection Connection) error
 
 type Connection interface {
 	ID() string
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
 	Reader() Reader
 	Writer() Writer
 	AddCloseCallback(callback CloseCallback)
 	Close() error
+	// SendFile flushes pending output and then sends n bytes of f starting
+	// at offset, or everything up to the end of f if n is negative. It
+	// returns the number of bytes sent even when it fails part way.
+	SendFile(f *os.File, offset, n int64) (int64, error)
 
 	io.Reader
 	io.Writer
 }
+
+type TLSConnection interface {
+	Connection
+	ConnectionState() tls.ConnectionState
+}
@@ -2,32 +2,83 @@ package anet
 
 import (
 	"context"
-	"errors"
 	"io"
 	"net"
 	"os"
+	"runtime"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type connection struct {
-	id                string
-	fd                int
-	file              *os.File
-	conn              net.Conn
-	context           context.Context
-	operator          *FDOperator
-	waitReadSize      int32
-	readTimeout       time.Duration
-	writeTimeout      time.Duration
-	readTrigger       chan error
-	writeTrigger      chan error
+	id             string
+	fd             int
+	context        context.Context
+	operator       *FDOperator
+	waitReadSize   int32
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	idleTimer      *time.Timer
+	lastActive     int64
+	readTrigger    chan error
+	writeTrigger   chan error
+	connectTrigger chan error
+	spliceTrigger  chan spliceResult
+	readPending    int32
+	readDeadline   int64
+	bufferSelect   bool
+	// whether the ring had provided buffers when the connection was set up,
+	// the operator may migrate to another ring later on
+	providedBuffers   bool
+	multishot         bool
+	readErr           error
+	writePending      int32
+	writeDeadline     int64
+	writeData         []byte
+	writeMsg          syscall.Msghdr
+	writeIovecs       []syscall.Iovec
+	writePinner       runtime.Pinner
 	inputBuffer       ReadWriter
 	outputBuffer      ReadWriter
+	bufferPool        BufferPool
 	onRequestCallback OnRequest
+	closeCallbacks    []CloseCallback
+	mu                sync.Mutex
+	closed            chan struct{}
 	state             int32 // 0: connected, 1: closed
+	// counters and observer of the event loop that accepted the connection,
+	// nil for connections created with Dial
+	stats       *loopStats
+	observer    Observer
+	closeReason error
+	// submission times in unix nanoseconds of the pending read and write,
+	// only kept for the observer
+	readStart  int64
+	writeStart int64
+	// the operator and the handler of an accepted connection, or the caller
+	// of a dialed one, each hold the buffers, the last one to let go of them
+	// recycles them
+	bufferRefs int32
+	// set while the caller of Dial holds the buffers, it lets go of them
+	// with the first Release after Close
+	dialHold int32
+	// the wrapper of a TLS connection, its buffers are recycled along
+	tls *tlsConnection
+	// set once the event loop that accepted the connection shuts down, the
+	// handler is not called again then
+	loopClosed *int32
+	// deadlines in unix nanoseconds set through the net.Conn that a TLS
+	// connection runs on, zero if there is none
+	readUntil  int64
+	writeUntil int64
+	// the OnRequest times of this connection, which are counted for the
+	// event loop as well
+	latency *latencyHistogram
 }
 
 var _ Reader = &connection{}
@@ -40,6 +91,22 @@ func (c *connection) ID() string {
 	return c.id
 }
 
+func (c *connection) LocalAddr() net.Addr {
+	sa, err := syscall.Getsockname(c.fd)
+	if err != nil {
+		return nil
+	}
+	return netAddrFromSockaddr(sa)
+}
+
+func (c *connection) RemoteAddr() net.Addr {
+	sa, err := syscall.Getpeername(c.fd)
+	if err != nil {
+		return nil
+	}
+	return netAddrFromSockaddr(sa)
+}
+
 func (c *connection) Seek(n int) ([]byte, error) {
 	return c.inputBuffer.Seek(n)
 }
@@ -57,19 +124,20 @@ func (c *connection) ReadAll() ([]byte, error) {
 }
 
 func (c *connection) ReadUtil(delim byte) ([]byte, error) {
+	if c.isClosed() {
+		return nil, ErrConnClosed
+	}
 	return c.waitReadUntil(delim)
 }
 
 func (c *connection) ReadBytes(n int) ([]byte, error) {
+	if c.isClosed() {
+		return nil, ErrConnClosed
+	}
 	if c.inputBuffer.Len() >= n {
 		return c.inputBuffer.ReadBytes(n)
 	}
-	var err error
-	if c.readTimeout != 0 {
-		err = c.waitReadWithTimeout(n, c.readTimeout)
-	} else {
-		err = c.waitRead(n)
-	}
+	err := c.waitRead(n)
 	if err != nil {
 		return nil, err
 	}
@@ -77,49 +145,135 @@ func (c *connection) ReadBytes(n int) ([]byte, error) {
 }
 
 func (c *connection) ReadString(n int) (string, error) {
+	if c.isClosed() {
+		return "", ErrConnClosed
+	}
 	if c.inputBuffer.Len() >= n {
 		return c.inputBuffer.ReadString(n)
 	}
-	var err error
-	if c.readTimeout != 0 {
-		err = c.waitReadWithTimeout(n, c.readTimeout)
-	} else {
-		err = c.waitRead(n)
-	}
+	err := c.waitRead(n)
 	if err != nil {
 		return "", err
 	}
 	return c.inputBuffer.ReadString(n)
 }
 
+func (c *connection) Slice(n int) (Reader, error) {
+	if c.isClosed() {
+		return nil, ErrConnClosed
+	}
+	if c.inputBuffer.Len() < n {
+		err := c.waitRead(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.inputBuffer.Slice(n)
+}
+
 func (c *connection) Len() int {
 	return c.inputBuffer.Len()
 }
 
 func (c *connection) Release() {
 	c.inputBuffer.Release()
+	c.releaseDialHold()
 }
 
 func (c *connection) WriteBytes(data []byte, n int) error {
+	if c.isClosed() {
+		return ErrConnClosed
+	}
 	err := c.outputBuffer.WriteBytes(data, n)
 	return err
 }
 
 func (c *connection) WriteString(data string, n int) error {
+	if c.isClosed() {
+		return ErrConnClosed
+	}
 	err := c.outputBuffer.WriteString(data, n)
 	return err
 }
 
+// WriteDirect queues p without copying it, p must stay untouched until the
+// next Flush returns.
+func (c *connection) WriteDirect(p []byte) error {
+	if c.isClosed() {
+		return ErrConnClosed
+	}
+	return c.outputBuffer.WriteDirect(p)
+}
+
 func (c *connection) Flush() error {
-	var err error
-	if c.writeTimeout != 0 {
-		err = c.waitFlushWithTimeout(c.writeTimeout)
-	} else {
-		err = c.waitFlush()
+	if c.isClosed() {
+		return ErrConnClosed
+	}
+	err := c.waitFlush()
+	if err == nil {
+		c.outputBuffer.Release()
 	}
 	return err
 }
 
+func (c *connection) SendFile(f *os.File, offset, n int64) (int64, error) {
+	if c.isClosed() {
+		return 0, ErrConnClosed
+	}
+	if n < 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		n = info.Size() - offset
+	}
+	deadline := c.writeDeadlineOf()
+	err := c.Flush()
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, nil
+	}
+
+	var p [2]int
+	err = syscall.Pipe2(p[:], syscall.O_CLOEXEC)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+	defer runtime.KeepAlive(f)
+
+	fd := int(f.Fd())
+	var sent int64
+	for sent < n {
+		size := n - sent
+		if size > maxSpliceSize {
+			size = maxSpliceSize
+		}
+		k, err := c.waitSplice(fd, offset+sent, p[1], int(size), deadline)
+		if err != nil {
+			return sent, err
+		}
+		if k == 0 {
+			return sent, io.EOF
+		}
+		// everything moved into the pipe has to reach the socket before
+		// the next chunk is read from the file
+		for k > 0 {
+			m, err := c.waitSplice(p[0], -1, c.fd, k, deadline)
+			if err != nil {
+				return sent, err
+			}
+			c.countWritten(m)
+			sent += int64(m)
+			k -= m
+		}
+	}
+	return sent, nil
+}
+
 func (c *connection) Book(n int) []byte {
 	return c.outputBuffer.Book(n)
 }
@@ -130,6 +284,9 @@ func (c *connection) BookAck(n int) error {
 }
 
 func (c *connection) Read(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, ErrConnClosed
+	}
 	if len(p) == 0 {
 		return 0, nil
 	}
@@ -152,7 +309,7 @@ func (c *connection) Read(p []byte) (int, error) {
 	}
 	err := c.waitRead(1)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	if c.inputBuffer.Len() > len(p) {
 		data, err := c.inputBuffer.ReadBytes(len(p))
@@ -172,6 +329,9 @@ func (c *connection) Read(p []byte) (int, error) {
 }
 
 func (c *connection) Write(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, ErrConnClosed
+	}
 	err := c.outputBuffer.WriteBytes(p, len(p))
 	if err != nil {
 		return 0, err
@@ -187,101 +347,299 @@ func (c *connection) Writer() Writer {
 	return c
 }
 
-func (c *connection) AddCloseCallback(callback CloseCallback) {}
+func (c *connection) AddCloseCallback(callback CloseCallback) {
+	if callback == nil {
+		return
+	}
+	c.mu.Lock()
+	if !c.isClosed() {
+		c.closeCallbacks = append(c.closeCallbacks, callback)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	c.runCloseCallback(callback)
+}
 
 func (c *connection) Close() error {
-	c.operator.Free()
-	c.file.Close()
-	c.conn.Close()
+	c.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&c.state, 0, 1) {
+		c.mu.Unlock()
+		return nil
+	}
+	callbacks := c.closeCallbacks
+	c.closeCallbacks = nil
+	reason := c.closeReason
+	close(c.closed)
+	c.mu.Unlock()
+
+	if c.observer != nil {
+		// the operator is released once drained, so the ring is looked up
+		// before
+		c.observer.OnClose(c.info(), reason)
+	}
+
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	// requests still in flight refer to the fd, so the fd and the operator
+	// are only released after the ring has delivered their completions
+	_ = syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+	c.operator.Drain(c.release)
+	for _, callback := range callbacks {
+		c.runCloseCallback(callback)
+	}
 	return nil
 }
 
-func (c *connection) init(conn net.Conn, opts *options) {
-	file, err := conn.(*net.TCPConn).File()
+func (c *connection) release() {
+	c.operator.Free()
+	err := syscall.Close(c.fd)
+	if err != nil {
+		log.Warnf("[connection %s] failed to close fd: %s", c.id, err.Error())
+	}
+	c.releaseBuffers()
+}
+
+// setCloseReason records why the connection is about to be closed for the
+// observer, the first reason sticks.
+func (c *connection) setCloseReason(reason error) {
+	if c.observer == nil {
+		return
+	}
+	c.mu.Lock()
+	if c.closeReason == nil {
+		c.closeReason = reason
+	}
+	c.mu.Unlock()
+}
+
+// info must only be called while the operator is known to be registered,
+// during a completion or before the connection is closed.
+func (c *connection) info() ConnInfo {
+	return ConnInfo{ConnectionID: c.id, RingID: c.operator.ringID()}
+}
+
+// openInfo returns the info of the connection unless it has been closed, its
+// operator may be released already then.
+func (c *connection) openInfo() (ConnInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed() {
+		return ConnInfo{}, false
+	}
+	return c.info(), true
+}
+
+// timeout returns the error of an operation that timed out and tells the
+// observer, unless the timeout is just the cancellation of a close.
+func (c *connection) timeout(op string) error {
+	if c.observer != nil {
+		if info, ok := c.openInfo(); ok {
+			c.observer.OnTimeout(info, op)
+		}
+	}
+	return &TimeoutError{Op: op}
+}
+
+func (c *connection) isClosed() bool {
+	return atomic.LoadInt32(&c.state) != 0
+}
+
+func (c *connection) runCloseCallback(callback CloseCallback) {
+	err := callback(c)
 	if err != nil {
-		panic("shouldn't failed here")
+		log.Warnf("[connection %s] close callback returned error: %s", c.id, err.Error())
 	}
-	c.fd = int(file.Fd())
-	c.file = file
-	c.conn = conn
+}
 
-	ring := RingManager.Pick()
+func (c *connection) init(fd int, raddr net.Addr, opts *options) {
+	c.fd = fd
+
+	ring := GetRingManager().Pick(raddr)
 	op := ring.Alloc()
 	op.FD = c.fd
 	op.OnRead = c.onRead
 	op.OnWrite = c.onWrite
+	op.OnConnect = c.onConnect
+	op.OnReadBuffer = c.onReadBuffer
+	op.OnSplice = c.onSplice
 	op.Ring = ring
 	op.Register()
 	c.operator = op
 
 	c.state = 0
 	c.waitReadSize = 0
-	c.readTimeout = 0
-	c.writeTimeout = 0
+	c.readTimeout = opts.readTimeout
+	c.writeTimeout = opts.writeTimeout
+	c.idleTimeout = opts.idleTimeout
 	c.id = uuid.New().String()[:8]
 	c.context = context.Background()
-	c.readTrigger = make(chan error)
-	c.writeTrigger = make(chan error)
-	c.inputBuffer = NewBytesBuffer(4096)
-	c.outputBuffer = NewBytesBuffer(4096)
+	c.readTrigger = make(chan error, 1)
+	c.writeTrigger = make(chan error, 1)
+	c.connectTrigger = make(chan error, 1)
+	c.spliceTrigger = make(chan spliceResult, 1)
+	c.closed = make(chan struct{})
+	c.bufferPool = opts.bufferPool
+	c.inputBuffer = NewPooledLinkBuffer(defaultLinkBlockSize, c.bufferPool)
+	c.outputBuffer = NewPooledLinkBuffer(defaultLinkBlockSize, c.bufferPool)
+	c.bufferRefs = 1
 	c.onRequestCallback = opts.onRequest
+	c.providedBuffers = ring.ProvidedBuffers()
+	if opts.multishotRecv && c.providedBuffers {
+		// completions of a multishot receive land in the input buffer while
+		// the handler is reading from it
+		c.multishot = true
+		c.inputBuffer = newSyncBuffer(c.inputBuffer)
+	}
+
+	if opts.keepAlive > 0 && !isUnixSocket(c.fd) {
+		err := setKeepAlive(c.fd, opts.keepAlive)
+		if err != nil {
+			log.Warnf("[connection %s] failed to enable keepalive: %s", c.id, err.Error())
+		}
+	}
+	if c.idleTimeout > 0 {
+		c.touch()
+		c.idleTimer = time.AfterFunc(c.idleTimeout, c.checkIdle)
+	}
+}
+
+func (c *connection) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
 }
 
-func (c *connection) run() {
-	defer c.Close()
+func (c *connection) checkIdle() {
+	if c.isClosed() {
+		return
+	}
+	idle := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&c.lastActive))
+	if idle >= c.idleTimeout {
+		log.Infof("[connection %s] close connection since idle for %s", c.id, idle)
+		c.setCloseReason(c.timeout("idle"))
+		_ = c.Close()
+		return
+	}
+	c.idleTimer.Reset(c.idleTimeout - idle)
+}
+
+func (c *connection) run(handle Connection) {
+	defer handle.Close()
 
 	for {
-		err := c.onRequestCallback(c.context, c)
+		var start time.Time
+		if c.latency != nil {
+			start = time.Now()
+		}
+		err := c.onRequestCallback(c.context, handle)
+		if c.latency != nil {
+			d := time.Since(start)
+			c.latency.observe(d)
+			c.stats.latency.observe(d)
+		}
 		if err != nil {
+			c.setCloseReason(err)
+			return
+		}
+		if c.context.Err() != nil || c.loopClosed != nil && atomic.LoadInt32(c.loopClosed) != 0 {
+			c.setCloseReason(ErrEventLoopClosed)
 			return
 		}
 	}
 }
 
+func (c *connection) holdBuffers() {
+	atomic.AddInt32(&c.bufferRefs, 1)
+}
+
+// holdDialBuffers keeps the buffers of a dialed connection after Close, the
+// slices handed out by its reads stay valid until the caller releases them.
+func (c *connection) holdDialBuffers() {
+	c.holdBuffers()
+	atomic.StoreInt32(&c.dialHold, 1)
+}
+
+func (c *connection) releaseDialHold() {
+	if c.isClosed() && atomic.CompareAndSwapInt32(&c.dialHold, 1, 0) {
+		c.releaseBuffers()
+	}
+}
+
+func (c *connection) releaseBuffers() {
+	if atomic.AddInt32(&c.bufferRefs, -1) == 0 {
+		c.recycleBuffers()
+	}
+}
+
+// recycleBuffers returns the buffer memory once neither the ring nor the
+// handler use the connection anymore.
+func (c *connection) recycleBuffers() {
+	// a booked read that never completed keeps its block pinned, the rest of
+	// the input buffer can go
+	if buffer, ok := c.inputBuffer.(interface{ recycle() }); ok {
+		buffer.recycle()
+	}
+	if buffer, ok := c.outputBuffer.(interface{ recycle() }); ok && atomic.LoadInt32(&c.writePending) == 0 {
+		buffer.recycle()
+	}
+	if c.tls != nil {
+		c.tls.recycleBuffers()
+	}
+}
+
+func (c *connection) waitConnect(ctx context.Context, sockaddr []byte) error {
+	c.submitConnect(sockaddr)
+	select {
+	case err := <-c.connectTrigger:
+		runtime.KeepAlive(sockaddr)
+		return err
+	case <-c.closed:
+		return ErrConnClosed
+	case <-ctx.Done():
+		// the connect request is still owned by the ring, so the operator
+		// can only be released after its completion has been delivered
+		go func() {
+			select {
+			case <-c.connectTrigger:
+			case <-c.closed:
+			}
+			runtime.KeepAlive(sockaddr)
+			_ = c.Close()
+		}()
+		return ctx.Err()
+	}
+}
+
 func (c *connection) waitRead(n int) error {
 	if c.inputBuffer.Len() >= n {
 		return nil
 	}
+	atomic.StoreInt32(&c.waitReadSize, int32(n))
+	defer atomic.StoreInt32(&c.waitReadSize, 0)
+	deadline := c.readDeadlineOf()
 	for c.inputBuffer.Len() < n {
-		c.submitRead()
-		err := <-c.readTrigger
+		err := c.fill(deadline)
 		if err != nil {
 			return err
 		}
-		if c.inputBuffer.Len() == 0 {
-			return errors.New("EOF")
-		}
 	}
 	return nil
 }
 
 func (c *connection) waitReadUntil(delim byte) ([]byte, error) {
+	deadline := c.readDeadlineOf()
+	// the data scanned so far is not looked at again after a fill
+	scanned := 0
 	for {
-		if c.inputBuffer.Len() > 0 {
-			data, err := c.inputBuffer.SeekAll()
-			if err != nil {
-				return nil, err
-			}
-			index := -1
-			for i, b := range data {
-				if b == delim {
-					index = i
-					break
-				}
-			}
-			if index != -1 {
-				_ = c.inputBuffer.SeekAck(index + 1)
-				return data[:index+1], nil
-			}
+		index, n := indexByte(c.inputBuffer, delim, scanned)
+		if index >= 0 {
+			return c.inputBuffer.ReadBytes(index + 1)
 		}
-		c.submitRead()
-		err := <-c.readTrigger
+		scanned = n
+		err := c.fill(deadline)
 		if err != nil {
 			return nil, err
 		}
-		if c.inputBuffer.Len() == 0 {
-			return nil, errors.New("EOF")
-		}
 	}
 }
 
@@ -289,9 +647,14 @@ func (c *connection) waitFlush() error {
 	if c.outputBuffer.Len() == 0 {
 		return nil
 	}
+	deadline := c.writeDeadlineOf()
+	atomic.StoreInt64(&c.writeDeadline, deadline)
 	for c.outputBuffer.Len() > 0 {
+		if expired(deadline) {
+			return c.timeout("write")
+		}
 		c.submitWrite()
-		err := <-c.writeTrigger
+		err := c.wait(c.writeTrigger)
 		if err != nil {
 			return err
 		}
@@ -299,40 +662,116 @@ func (c *connection) waitFlush() error {
 	return nil
 }
 
-func (c *connection) waitReadWithTimeout(n int, timeout time.Duration) error {
-	if c.inputBuffer.Len() >= n {
-		return nil
+func (c *connection) waitSplice(in int, offset int64, out int, size int, deadline int64) (int, error) {
+	if expired(deadline) {
+		return 0, c.timeout("sendfile")
 	}
-	atomic.StoreInt32(&c.waitReadSize, int32(n))
-	defer atomic.StoreInt32(&c.waitReadSize, 0)
-	timer := time.NewTimer(timeout)
-	for c.inputBuffer.Len() < n {
-		select {
-		case err := <-c.readTrigger:
-			if err != nil {
-				return err
-			}
-		case <-timer.C:
-			return errors.New("timeout")
-		}
+	c.submitSplice(in, offset, out, size, timeoutUntil(deadline))
+	select {
+	case res := <-c.spliceTrigger:
+		return res.n, res.err
+	case <-c.closed:
+		return 0, ErrConnClosed
 	}
-	return nil
 }
 
-func (c *connection) waitFlushWithTimeout(timeout time.Duration) error {
-	if c.outputBuffer.Len() == 0 {
+// fill waits for the next read completion, in multishot mode that is either
+// more data in the input buffer or the error which ended the receive.
+func (c *connection) fill(deadline int64) error {
+	if err := c.readError(); err != nil {
+		return err
+	}
+	if expired(deadline) {
+		return c.timeout("read")
+	}
+	atomic.StoreInt64(&c.readDeadline, deadline)
+	c.submitRead()
+	if c.multishot && deadline != 0 {
+		// a linked timeout would end the multishot receive, so it is
+		// bounded by a timer instead
+		return c.waitUntil(c.readTrigger, deadline, "read")
+	}
+	return c.wait(c.readTrigger)
+}
+
+func (c *connection) readError() error {
+	if !c.multishot {
 		return nil
 	}
-	timer := time.NewTimer(timeout)
-	for c.outputBuffer.Len() > 0 {
-		select {
-		case err := <-c.writeTrigger:
-			if err != nil {
-				return err
-			}
-		case <-timer.C:
-			return errors.New("timeout")
-		}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readErr
+}
+
+func (c *connection) waitUntil(trigger chan error, deadline int64, op string) error {
+	timer := time.NewTimer(time.Duration(deadline - time.Now().UnixNano()))
+	defer timer.Stop()
+	select {
+	case err := <-trigger:
+		return err
+	case <-c.closed:
+		return ErrConnClosed
+	case <-timer.C:
+		return c.timeout(op)
 	}
-	return nil
+}
+
+func (c *connection) wait(trigger chan error) error {
+	select {
+	case err := <-trigger:
+		return err
+	case <-c.closed:
+		return ErrConnClosed
+	}
+}
+
+// deadlineOf returns the deadline in unix nanoseconds of an operation with
+// timeout started now, zero if there is no timeout.
+func deadlineOf(timeout time.Duration) int64 {
+	if timeout <= 0 {
+		return 0
+	}
+	return time.Now().Add(timeout).UnixNano()
+}
+
+// readDeadlineOf returns the deadline of a read started now, the earlier of
+// the read timeout and the deadline set on the connection.
+func (c *connection) readDeadlineOf() int64 {
+	return earliest(deadlineOf(c.readTimeout), atomic.LoadInt64(&c.readUntil))
+}
+
+func (c *connection) writeDeadlineOf() int64 {
+	return earliest(deadlineOf(c.writeTimeout), atomic.LoadInt64(&c.writeUntil))
+}
+
+func earliest(a, b int64) int64 {
+	if a == 0 || b != 0 && b < a {
+		return b
+	}
+	return a
+}
+
+// unixNano converts a deadline of net.Conn to unix nanoseconds.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func expired(deadline int64) bool {
+	return deadline != 0 && time.Now().UnixNano() >= deadline
+}
+
+// timeoutUntil returns the timeout to link to a request that has to finish
+// by deadline.
+func timeoutUntil(deadline int64) time.Duration {
+	if deadline == 0 {
+		return 0
+	}
+	timeout := time.Duration(deadline - time.Now().UnixNano())
+	if timeout <= 0 {
+		return time.Nanosecond
+	}
+	return timeout
 }
@@ -0,0 +1,185 @@
+package anet
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionCloseCallbacks(t *testing.T) {
+	listener := listenEcho(t)
+	conn, err := Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	var calls []int
+	for i := 0; i < 3; i++ {
+		i := i
+		conn.AddCloseCallback(func(connection Connection) error {
+			require.Same(t, conn, connection)
+			calls = append(calls, i)
+			return nil
+		})
+	}
+	conn.AddCloseCallback(nil)
+
+	// the callbacks run once, in the order they were added
+	require.NoError(t, conn.Close())
+	require.Equal(t, []int{0, 1, 2}, calls)
+	require.NoError(t, conn.Close())
+	require.Equal(t, []int{0, 1, 2}, calls)
+
+	// one added after Close runs at once
+	conn.AddCloseCallback(func(connection Connection) error {
+		calls = append(calls, 3)
+		return nil
+	})
+	require.Equal(t, []int{0, 1, 2, 3}, calls)
+	require.NoError(t, conn.Close())
+	require.Equal(t, []int{0, 1, 2, 3}, calls)
+}
+
+func TestConnectionClosedIO(t *testing.T) {
+	listener := listenEcho(t)
+	conn, err := Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	// a read waiting for data is woken up by Close
+	result := make(chan error, 1)
+	go func() {
+		_, err := conn.Reader().ReadBytes(1)
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, conn.Close())
+	select {
+	case err := <-result:
+		require.ErrorIs(t, err, ErrConnClosed)
+	case <-time.After(time.Second):
+		t.Fatalf("read was not woken up by Close")
+	}
+
+	reader, writer := conn.Reader(), conn.Writer()
+	_, err = reader.ReadBytes(1)
+	require.ErrorIs(t, err, ErrConnClosed)
+	_, err = reader.ReadString(1)
+	require.ErrorIs(t, err, ErrConnClosed)
+	_, err = reader.ReadUtil('\n')
+	require.ErrorIs(t, err, ErrConnClosed)
+	_, err = reader.Slice(1)
+	require.ErrorIs(t, err, ErrConnClosed)
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, ErrConnClosed)
+	require.ErrorIs(t, writer.WriteBytes([]byte("ping"), 4), ErrConnClosed)
+	require.ErrorIs(t, writer.WriteString("ping", 4), ErrConnClosed)
+	require.ErrorIs(t, writer.WriteDirect([]byte("ping")), ErrConnClosed)
+	require.ErrorIs(t, writer.Flush(), ErrConnClosed)
+	_, err = conn.Write([]byte("ping"))
+	require.ErrorIs(t, err, ErrConnClosed)
+}
+
+func TestConnectionIdleTimeout(t *testing.T) {
+	listener := listenEcho(t)
+	dial := func() (Connection, chan struct{}) {
+		conn, err := Dial("tcp", listener.Addr().String(), WithIdleTimeout(50*time.Millisecond))
+		require.NoError(t, err)
+		closed := make(chan struct{})
+		conn.AddCloseCallback(func(connection Connection) error {
+			close(closed)
+			return nil
+		})
+		return conn, closed
+	}
+
+	// traffic keeps the connection open well past the idle timeout
+	busy, busyClosed := dial()
+	defer busy.Close()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, busy.Writer().WriteString("ping", 4))
+		require.NoError(t, busy.Writer().Flush())
+		data, err := busy.Reader().ReadString(4)
+		require.NoError(t, err)
+		require.Equal(t, "ping", data)
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case <-busyClosed:
+		t.Fatalf("busy connection was closed")
+	default:
+	}
+
+	// an idle one is closed once the timeout passes
+	_, idleClosed := dial()
+	select {
+	case <-idleClosed:
+	case <-time.After(time.Second):
+		t.Fatalf("idle connection was not closed")
+	}
+}
+
+func TestConnectionKeepAlive(t *testing.T) {
+	listener, err := CreateListener("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	fds := make(chan int, 1)
+	eventLoop, err := NewEventLoop(func(ctx context.Context, conn Connection) error {
+		select {
+		case fds <- conn.(*connection).fd:
+		default:
+		}
+		_, err := conn.Reader().ReadBytes(1)
+		return err
+	}, WithKeepAlive(30*time.Second))
+	require.NoError(t, err)
+	go func() {
+		_ = eventLoop.Serve(listener)
+	}()
+	defer func() {
+		_ = eventLoop.Shutdown(context.Background())
+		_ = listener.Close()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	var fd int
+	select {
+	case fd = <-fds:
+	case <-time.After(time.Second):
+		t.Fatalf("connection was not accepted")
+	}
+	// the probes start after the period and repeat at the same interval
+	keepAlive, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	require.NoError(t, err)
+	require.Equal(t, 1, keepAlive)
+	idle, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	require.NoError(t, err)
+	require.Equal(t, 30, idle)
+	interval, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+	require.NoError(t, err)
+	require.Equal(t, 30, interval)
+}
+
+func TestConnectionWriteTimeout(t *testing.T) {
+	// the peer accepts but never reads, so its window fills up
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	conn, err := Dial("tcp", listener.Addr().String(), WithWriteTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	defer conn.Close()
+	peer, err := listener.Accept()
+	require.NoError(t, err)
+	defer peer.Close()
+
+	data := make([]byte, 64<<20)
+	require.NoError(t, conn.Writer().WriteBytes(data, len(data)))
+	start := time.Now()
+	err = conn.Writer().Flush()
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Equal(t, "write", timeoutErr.Op)
+	require.Less(t, time.Since(start), time.Second)
+}
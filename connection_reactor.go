@@ -1,32 +1,280 @@
 package anet
 
+import (
+	"io"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
 const (
 	defaultReadSize = 1024
+	maxSpliceSize   = 1 << 16
 )
 
+type spliceResult struct {
+	n   int
+	err error
+}
+
 func (c *connection) onRead(n int, err error) {
-	_ = c.inputBuffer.BookAck(n)
-	c.readTrigger <- err
+	// a failed request completes with the negated errno
+	if err != nil {
+		n = 0
+	}
+	if c.multishot {
+		// a booked read stands in for the multishot receive after the
+		// provided buffers ran dry, its completion must not block the ring
+		// either
+		// a failed read acks nothing, which still unpins the booked block
+		_ = c.inputBuffer.BookAck(n)
+		c.countRead(n)
+		c.onRecvMultishot(n, false, err)
+		return
+	}
+	if c.idleTimeout > 0 && n > 0 {
+		c.touch()
+	}
+	if !c.bufferSelect {
+		_ = c.inputBuffer.BookAck(n)
+		c.countRead(n)
+	}
+	if n == 0 && err == nil {
+		err = io.EOF
+	} else if err == syscall.ECANCELED {
+		err = c.timeout("read")
+	}
+	if c.observer != nil {
+		c.observer.OnRead(c.info(), n, err, since(&c.readStart))
+	}
+	atomic.StoreInt32(&c.readPending, 0)
+	c.notify(c.readTrigger, err)
+}
+
+func (c *connection) onReadBuffer(data []byte, bid int, more bool, err error) {
+	if len(data) > 0 {
+		c.countRead(len(data))
+		_ = c.inputBuffer.WriteBytes(data, len(data))
+	}
+	if bid >= 0 {
+		c.operator.Ring.RecycleBuffer(bid)
+	}
+	if err == syscall.ENOBUFS {
+		// the shared pool of the ring ran dry, so this read falls back to
+		// space booked from the input buffer, and the next waiter arms the
+		// multishot receive again
+		c.submitBookedRead()
+		return
+	}
+	if !c.multishot {
+		c.onRead(len(data), err)
+		return
+	}
+	c.onRecvMultishot(len(data), more, err)
+}
+
+// onRecvMultishot handles a completion of the armed multishot receive, which
+// must never block the ring since more completions may follow.
+func (c *connection) onRecvMultishot(n int, more bool, err error) {
+	if c.idleTimeout > 0 && n > 0 {
+		c.touch()
+	}
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+	if c.observer != nil {
+		c.observer.OnRead(c.info(), n, err, since(&c.readStart))
+		// the next completion of the receive is timed from this one
+		atomic.StoreInt64(&c.readStart, time.Now().UnixNano())
+	}
+	if err != nil && err != syscall.ECANCELED {
+		c.mu.Lock()
+		if c.readErr == nil {
+			c.readErr = err
+		}
+		c.mu.Unlock()
+	}
+	if !more {
+		// the next waiter arms a new receive unless an error ended this one
+		atomic.StoreInt32(&c.readPending, 0)
+	}
+	select {
+	case c.readTrigger <- nil:
+	default:
+	}
 }
 
 func (c *connection) onWrite(n int, err error) {
-	_ = c.outputBuffer.SeekAck(n)
-	c.writeTrigger <- err
+	if err != nil {
+		n = 0
+	}
+	if c.idleTimeout > 0 && n > 0 {
+		c.touch()
+	}
+	if n > 0 {
+		c.countWritten(n)
+		_ = c.outputBuffer.SeekAck(n)
+	} else if err == syscall.ECANCELED {
+		err = c.timeout("write")
+	}
+	if c.observer != nil {
+		c.observer.OnWrite(c.info(), n, err, since(&c.writeStart))
+	}
+	c.writeData = nil
+	c.writePinner.Unpin()
+	atomic.StoreInt32(&c.writePending, 0)
+	c.notify(c.writeTrigger, err)
+}
+
+func (c *connection) onSplice(n int, err error) {
+	if c.idleTimeout > 0 && n > 0 {
+		c.touch()
+	}
+	if err == syscall.ECANCELED {
+		err = c.timeout("sendfile")
+	}
+	if err != nil {
+		n = 0
+	}
+	select {
+	case c.spliceTrigger <- spliceResult{n: n, err: err}:
+	case <-c.closed:
+	}
+}
+
+func (c *connection) onConnect(err error) {
+	c.notify(c.connectTrigger, err)
+}
+
+func (c *connection) countRead(n int) {
+	if c.stats != nil {
+		atomic.AddUint64(&c.stats.bytesRead, uint64(n))
+	}
+}
+
+func (c *connection) countWritten(n int) {
+	if c.stats != nil {
+		atomic.AddUint64(&c.stats.bytesWritten, uint64(n))
+	}
+}
+
+// started records when a request was submitted, the observer is told the time
+// until its completion.
+func (c *connection) started(start *int64) {
+	if c.observer != nil {
+		atomic.StoreInt64(start, time.Now().UnixNano())
+	}
+}
+
+func since(start *int64) time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(start))
+}
+
+func (c *connection) notify(trigger chan error, err error) {
+	select {
+	case trigger <- err:
+	case <-c.closed:
+	}
 }
 
 func (c *connection) submitRead() {
+	// a read that outlived its waiter is still pending, so the next waiter
+	// just picks up its result instead of booking the same space twice
+	if !atomic.CompareAndSwapInt32(&c.readPending, 0, 1) {
+		return
+	}
+	if c.providedBuffers {
+		c.bufferSelect = true
+		eventData := RingEventData{}
+		eventData.Event = RingPrepRecv
+		eventData.Multishot = c.multishot
+		if !c.multishot {
+			eventData.Timeout = timeoutUntil(atomic.LoadInt64(&c.readDeadline))
+		}
+		c.started(&c.readStart)
+		c.operator.Submit(eventData)
+		return
+	}
+	c.submitBookedRead()
+}
+
+func (c *connection) submitBookedRead() {
+	c.bufferSelect = false
 	eventData := RingEventData{}
 	eventData.Size = defaultReadSize
 	eventData.Data = c.inputBuffer.Book(defaultReadSize)
 	eventData.Event = RingPrepRead
+	if !c.multishot {
+		eventData.Timeout = timeoutUntil(atomic.LoadInt64(&c.readDeadline))
+	}
+	c.started(&c.readStart)
 	c.operator.Submit(eventData)
 }
 
 func (c *connection) submitWrite() {
+	if !atomic.CompareAndSwapInt32(&c.writePending, 0, 1) {
+		return
+	}
+	if buffer, ok := c.outputBuffer.(interface{ chunks(max int) [][]byte }); ok {
+		if chunks := buffer.chunks(maxWriteChunks); len(chunks) > 1 {
+			c.submitWriteMsg(chunks)
+			return
+		}
+	}
 	size := c.outputBuffer.Len()
 	eventData := RingEventData{}
 	eventData.Size = size
 	eventData.Data, _ = c.outputBuffer.Seek(size)
 	eventData.Event = RingPrepWrite
+	eventData.Timeout = timeoutUntil(atomic.LoadInt64(&c.writeDeadline))
+	// Seek may return a merged copy of several blocks, which has to stay
+	// reachable until the kernel is done with it
+	c.writeData = eventData.Data
+	c.started(&c.writeStart)
+	c.operator.Submit(eventData)
+}
+
+// submitWriteMsg sends several chunks of the output buffer with one sendmsg,
+// a partial completion is acked across chunks by onWrite.
+func (c *connection) submitWriteMsg(chunks [][]byte) {
+	// the kernel reads the iovecs and the chunks until the request completes,
+	// so all of them stay pinned until onWrite
+	c.writeIovecs = c.writeIovecs[:0]
+	size := 0
+	for _, chunk := range chunks {
+		size += len(chunk)
+		c.writePinner.Pin(&chunk[0])
+		iovec := syscall.Iovec{Base: &chunk[0]}
+		iovec.SetLen(len(chunk))
+		c.writeIovecs = append(c.writeIovecs, iovec)
+	}
+	c.writePinner.Pin(&c.writeIovecs[0])
+	c.writeMsg = syscall.Msghdr{Iov: &c.writeIovecs[0]}
+	c.writeMsg.Iovlen = uint64(len(c.writeIovecs))
+	eventData := RingEventData{}
+	eventData.Size = size
+	eventData.Event = RingPrepSendMsg
+	eventData.Timeout = timeoutUntil(atomic.LoadInt64(&c.writeDeadline))
+	eventData.Msg = &c.writeMsg
+	c.started(&c.writeStart)
+	c.operator.Submit(eventData)
+}
+
+func (c *connection) submitSplice(in int, offset int64, out int, size int, timeout time.Duration) {
+	eventData := RingEventData{}
+	eventData.Size = size
+	eventData.Event = RingPrepSplice
+	eventData.Timeout = timeout
+	eventData.SpliceIn = in
+	eventData.SpliceOut = out
+	eventData.SpliceOffset = offset
+	c.operator.Submit(eventData)
+}
+
+func (c *connection) submitConnect(sockaddr []byte) {
+	eventData := RingEventData{}
+	eventData.Size = len(sockaddr)
+	eventData.Data = sockaddr
+	eventData.Event = RingPrepConnect
 	c.operator.Submit(eventData)
 }
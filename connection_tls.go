@@ -0,0 +1,340 @@
+package anet
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+func newTLSConnection(ctx context.Context, raw *connection, conn *tls.Conn) (*tlsConnection, error) {
+	err := conn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &tlsConnection{
+		raw:          raw,
+		conn:         conn,
+		inputBuffer:  NewPooledLinkBuffer(defaultLinkBlockSize, raw.bufferPool),
+		outputBuffer: NewPooledLinkBuffer(defaultLinkBlockSize, raw.bufferPool),
+	}
+	raw.tls = c
+	return c, nil
+}
+
+// tlsTransport exposes the ring driven connection as the net.Conn that
+// crypto/tls reads records from and writes records to.
+type tlsTransport struct {
+	connection *connection
+}
+
+var _ net.Conn = &tlsTransport{}
+
+func (t *tlsTransport) Read(p []byte) (int, error) {
+	return t.connection.Read(p)
+}
+
+func (t *tlsTransport) Write(p []byte) (int, error) {
+	err := t.connection.WriteBytes(p, len(p))
+	if err != nil {
+		return 0, err
+	}
+	err = t.connection.Flush()
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *tlsTransport) Close() error {
+	return t.connection.Close()
+}
+
+func (t *tlsTransport) LocalAddr() net.Addr {
+	return t.connection.LocalAddr()
+}
+
+func (t *tlsTransport) RemoteAddr() net.Addr {
+	return t.connection.RemoteAddr()
+}
+
+// SetDeadline bounds the reads and writes started from now on, crypto/tls
+// sets a write deadline for the close_notify alert sent by Close.
+func (t *tlsTransport) SetDeadline(deadline time.Time) error {
+	_ = t.SetReadDeadline(deadline)
+	return t.SetWriteDeadline(deadline)
+}
+
+func (t *tlsTransport) SetReadDeadline(deadline time.Time) error {
+	atomic.StoreInt64(&t.connection.readUntil, unixNano(deadline))
+	return nil
+}
+
+func (t *tlsTransport) SetWriteDeadline(deadline time.Time) error {
+	atomic.StoreInt64(&t.connection.writeUntil, unixNano(deadline))
+	return nil
+}
+
+type tlsConnection struct {
+	raw          *connection
+	conn         *tls.Conn
+	inputBuffer  ReadWriter
+	outputBuffer ReadWriter
+}
+
+var _ TLSConnection = &tlsConnection{}
+var _ ReadWriter = &tlsConnection{}
+var _ io.ReadWriter = &tlsConnection{}
+
+func (c *tlsConnection) ID() string {
+	return c.raw.ID()
+}
+
+func (c *tlsConnection) LocalAddr() net.Addr {
+	return c.raw.LocalAddr()
+}
+
+func (c *tlsConnection) RemoteAddr() net.Addr {
+	return c.raw.RemoteAddr()
+}
+
+func (c *tlsConnection) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState()
+}
+
+func (c *tlsConnection) Reader() Reader {
+	return c
+}
+
+func (c *tlsConnection) Writer() Writer {
+	return c
+}
+
+func (c *tlsConnection) AddCloseCallback(callback CloseCallback) {
+	if callback == nil {
+		return
+	}
+	c.raw.AddCloseCallback(func(_ Connection) error {
+		return callback(c)
+	})
+}
+
+func (c *tlsConnection) Close() error {
+	if c.raw.isClosed() {
+		return nil
+	}
+	_ = c.conn.Close()
+	return c.raw.Close()
+}
+
+// recycleBuffers is called by the raw connection once nothing uses the
+// connection anymore.
+func (c *tlsConnection) recycleBuffers() {
+	if buffer, ok := c.inputBuffer.(interface{ recycle() }); ok {
+		buffer.recycle()
+	}
+	if buffer, ok := c.outputBuffer.(interface{ recycle() }); ok {
+		buffer.recycle()
+	}
+}
+
+func (c *tlsConnection) Seek(n int) ([]byte, error) {
+	return c.inputBuffer.Seek(n)
+}
+
+func (c *tlsConnection) SeekAck(n int) error {
+	return c.inputBuffer.SeekAck(n)
+}
+
+func (c *tlsConnection) SeekAll() ([]byte, error) {
+	return c.inputBuffer.SeekAll()
+}
+
+func (c *tlsConnection) ReadAll() ([]byte, error) {
+	return c.inputBuffer.ReadAll()
+}
+
+func (c *tlsConnection) ReadUtil(delim byte) ([]byte, error) {
+	scanned := 0
+	for {
+		index, n := indexByte(c.inputBuffer, delim, scanned)
+		if index >= 0 {
+			return c.inputBuffer.ReadBytes(index + 1)
+		}
+		scanned = n
+		err := c.fill()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *tlsConnection) ReadBytes(n int) ([]byte, error) {
+	for c.inputBuffer.Len() < n {
+		err := c.fill()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.inputBuffer.ReadBytes(n)
+}
+
+func (c *tlsConnection) ReadString(n int) (string, error) {
+	for c.inputBuffer.Len() < n {
+		err := c.fill()
+		if err != nil {
+			return "", err
+		}
+	}
+	return c.inputBuffer.ReadString(n)
+}
+
+func (c *tlsConnection) Slice(n int) (Reader, error) {
+	for c.inputBuffer.Len() < n {
+		err := c.fill()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.inputBuffer.Slice(n)
+}
+
+func (c *tlsConnection) Len() int {
+	return c.inputBuffer.Len()
+}
+
+func (c *tlsConnection) Release() {
+	c.inputBuffer.Release()
+	c.raw.releaseDialHold()
+}
+
+func (c *tlsConnection) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if c.inputBuffer.Len() == 0 {
+		err := c.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := c.inputBuffer.Len()
+	if n > len(p) {
+		n = len(p)
+	}
+	data, err := c.inputBuffer.ReadBytes(n)
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, data), nil
+}
+
+func (c *tlsConnection) Book(n int) []byte {
+	return c.outputBuffer.Book(n)
+}
+
+func (c *tlsConnection) BookAck(n int) error {
+	return c.outputBuffer.BookAck(n)
+}
+
+func (c *tlsConnection) WriteBytes(data []byte, n int) error {
+	if c.raw.isClosed() {
+		return ErrConnClosed
+	}
+	return c.outputBuffer.WriteBytes(data, n)
+}
+
+func (c *tlsConnection) WriteString(data string, n int) error {
+	if c.raw.isClosed() {
+		return ErrConnClosed
+	}
+	return c.outputBuffer.WriteString(data, n)
+}
+
+func (c *tlsConnection) WriteDirect(p []byte) error {
+	if c.raw.isClosed() {
+		return ErrConnClosed
+	}
+	return c.outputBuffer.WriteDirect(p)
+}
+
+func (c *tlsConnection) Write(p []byte) (int, error) {
+	err := c.WriteBytes(p, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SendFile has to pass the file through the record layer, so unlike plain
+// connections it reads the file into user space.
+func (c *tlsConnection) SendFile(f *os.File, offset, n int64) (int64, error) {
+	if c.raw.isClosed() {
+		return 0, ErrConnClosed
+	}
+	if n < 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		n = info.Size() - offset
+	}
+	err := c.Flush()
+	if err != nil {
+		return 0, err
+	}
+	sent, err := io.Copy(c.conn, io.NewSectionReader(f, offset, n))
+	if err == nil && sent < n {
+		err = io.EOF
+	}
+	return sent, err
+}
+
+func (c *tlsConnection) Flush() error {
+	size := c.outputBuffer.Len()
+	if size == 0 {
+		return nil
+	}
+	data, err := c.outputBuffer.Seek(size)
+	if err != nil {
+		return err
+	}
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return err
+	}
+	_ = c.outputBuffer.SeekAck(size)
+	c.outputBuffer.Release()
+	return nil
+}
+
+// fill decrypts at least one more chunk of application data into the input buffer.
+func (c *tlsConnection) fill() error {
+	if c.raw.isClosed() {
+		return ErrConnClosed
+	}
+	for {
+		n, err := c.conn.Read(c.inputBuffer.Book(defaultReadSize))
+		if n > 0 {
+			_ = c.inputBuffer.BookAck(n)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func dialTLS(ctx context.Context, raw *connection, addr string, config *tls.Config) (*tlsConnection, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	return newTLSConnection(ctx, raw, tls.Client(&tlsTransport{connection: raw}, config))
+}
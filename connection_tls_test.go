@@ -0,0 +1,105 @@
+package anet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSTransportDeadlines(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	// the peer takes the connection and never reads from it nor writes to it
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	peer := <-accepted
+	defer peer.Close()
+
+	raw := conn.(*connection)
+	transport := &tlsTransport{connection: raw}
+	require.NoError(t, transport.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = transport.Read(make([]byte, 16))
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Equal(t, "read", timeoutErr.Op)
+
+	// the socket buffers fill up long before the data is written
+	require.NoError(t, transport.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = transport.Write(make([]byte, 64<<20))
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Equal(t, "write", timeoutErr.Op)
+
+	// a zero deadline removes it again
+	require.NoError(t, transport.SetDeadline(time.Time{}))
+	require.Zero(t, raw.readDeadlineOf())
+	require.Zero(t, raw.writeDeadlineOf())
+}
+
+func TestTLSCloseWithStalledPeer(t *testing.T) {
+	certificate := selfSignedCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	require.NoError(t, err)
+	defer listener.Close()
+	// the peer completes the handshake and stops reading afterwards
+	stalled := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.(*tls.Conn).Handshake()
+		stalled <- conn
+	}()
+	connection, err := Dial("tcp", listener.Addr().String(), WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	require.NoError(t, err)
+	peer := <-stalled
+	defer peer.Close()
+
+	// more data is queued in front of the close_notify alert than the
+	// socket buffers take
+	raw := connection.(*tlsConnection).raw
+	require.NoError(t, raw.WriteBytes(make([]byte, 64<<20), 64<<20))
+
+	// crypto/tls bounds the alert by a write deadline of five seconds
+	closed := make(chan error, 1)
+	go func() {
+		closed <- connection.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("close hangs on a peer that does not read")
+	}
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
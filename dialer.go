@@ -0,0 +1,95 @@
+package anet
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+)
+
+func Dial(network, addr string, ops ...Option) (Connection, error) {
+	return DialContext(context.Background(), network, addr, ops...)
+}
+
+func DialContext(ctx context.Context, network, addr string, ops ...Option) (Connection, error) {
+	opts := &options{}
+	for _, do := range ops {
+		do.f(opts)
+	}
+	var raddr net.Addr
+	var sockaddr []byte
+	var family int
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		tcpAddr, err := resolveTCPAddr(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		raddr = tcpAddr
+		sockaddr, family = sockaddrFromTCPAddr(tcpAddr)
+	case "unix":
+		unixAddr := &net.UnixAddr{Name: addr, Net: network}
+		raddr = unixAddr
+		var err error
+		sockaddr, family, err = sockaddrFromUnixAddr(unixAddr)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+		}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	connection := &connection{}
+	connection.init(fd, raddr, opts)
+	err = connection.waitConnect(ctx, sockaddr)
+	if err != nil {
+		if ctx.Err() == nil {
+			_ = connection.Close()
+		}
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+	}
+	if opts.tlsConfig != nil {
+		tlsConnection, err := dialTLS(ctx, connection, addr, opts.tlsConfig)
+		if err != nil {
+			_ = connection.Close()
+			return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+		}
+		connection.holdDialBuffers()
+		return tlsConnection, nil
+	}
+	connection.holdDialBuffers()
+	return connection, nil
+}
+
+func resolveTCPAddr(ctx context.Context, network, addr string) (*net.TCPAddr, error) {
+	host, service, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, network, service)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		if network == "tcp6" {
+			return &net.TCPAddr{IP: net.IPv6loopback, Port: port}, nil
+		}
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		switch {
+		case network == "tcp4" && ip.IP.To4() == nil:
+		case network == "tcp6" && ip.IP.To4() != nil:
+		default:
+			return &net.TCPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}, nil
+		}
+	}
+	return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+}
@@ -3,21 +3,30 @@ package httpserver
 import (
 	"net/http"
 
+	"github.com/zjregee/anet"
 	"github.com/zjregee/anet/ahttp"
 )
 
-func runServer(port string, stopChan chan interface{}) {
+// runServer serves the test routes on a free loopback port and returns the
+// address it listens on. The listener is created before it returns, so that
+// requests are not refused while the server starts.
+func runServer(stopChan chan interface{}) string {
 	server := ahttp.New()
 	server.GET("/test", func(c *ahttp.Context) error {
 		return c.NoContent(http.StatusOK)
 	})
 
+	listener, err := anet.CreateListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("shouldn't failed here")
+	}
 	go func() {
-		_ = server.Start(port)
+		_ = server.Serve(listener)
 	}()
 
 	go func() {
 		<-stopChan
 		_ = server.Shutdown()
 	}()
+	return listener.Addr().String()
 }
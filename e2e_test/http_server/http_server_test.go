@@ -9,23 +9,21 @@ import (
 )
 
 func TestHTTPServerSerial(t *testing.T) {
-	port := ":8003"
 	stopchan := make(chan interface{})
-	runServer(port, stopchan)
+	addr := runServer(stopchan)
 	defer close(stopchan)
 
 	m := 1000
 	for i := 0; i < m; i++ {
-		resp, err := http.Get("http://localhost" + port + "/test")
+		resp, err := http.Get("http://" + addr + "/test")
 		require.NoError(t, err)
 		require.Equal(t, http.StatusOK, resp.StatusCode)
 	}
 }
 
 func TestHTTPServerConcurrent(t *testing.T) {
-	port := ":8004"
 	stopchan := make(chan interface{})
-	runServer(port, stopchan)
+	addr := runServer(stopchan)
 	defer close(stopchan)
 
 	c := 12
@@ -36,7 +34,7 @@ func TestHTTPServerConcurrent(t *testing.T) {
 		go func(i int) {
 			defer wg.Done()
 			for i := 0; i < m; i++ {
-				resp, err := http.Get("http://localhost" + port + "/test")
+				resp, err := http.Get("http://" + addr + "/test")
 				require.NoError(t, err)
 				require.Equal(t, http.StatusOK, resp.StatusCode)
 			}
@@ -6,8 +6,14 @@ import (
 	"github.com/zjregee/anet"
 )
 
-func runServer(port string, stopChan chan interface{}) {
-	listener, err := anet.CreateListener("tcp", port)
+// runServer serves handleConnection on a free loopback port and returns the
+// address it listens on.
+func runServer(stopChan chan interface{}) string {
+	return runServerOn("tcp", "127.0.0.1:0", stopChan)
+}
+
+func runServerOn(network, addr string, stopChan chan interface{}) string {
+	listener, err := anet.CreateListener(network, addr)
 	if err != nil {
 		panic("shouldn't failed here")
 	}
@@ -25,6 +31,7 @@ func runServer(port string, stopChan chan interface{}) {
 		_ = eventLoop.Shutdown(context.Background())
 		_ = listener.Close()
 	}()
+	return listener.Addr().String()
 }
 
 func handleConnection(_ context.Context, connection anet.Connection) error {
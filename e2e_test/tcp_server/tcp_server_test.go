@@ -2,19 +2,31 @@ package tcpserver
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
+	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/zjregee/anet"
 )
 
 func TestTCPServerSerial(t *testing.T) {
-	port := ":8001"
 	stopchan := make(chan interface{})
-	runServer(port, stopchan)
+	addr := runServer(stopchan)
 	defer close(stopchan)
 
 	m := 1000
@@ -22,7 +34,7 @@ func TestTCPServerSerial(t *testing.T) {
 	messageLength := 48
 
 	for i := 0; i < m; i++ {
-		conn, err := net.Dial("tcp", port)
+		conn, err := net.Dial("tcp", addr)
 		if err != nil {
 			t.Fatalf("failed to connect to server: %v", err)
 		}
@@ -47,9 +59,8 @@ func TestTCPServerSerial(t *testing.T) {
 }
 
 func TestTCPServerConcurrent(t *testing.T) {
-	port := ":8002"
 	stopchan := make(chan interface{})
-	runServer(port, stopchan)
+	addr := runServer(stopchan)
 	defer close(stopchan)
 
 	c := 12
@@ -65,7 +76,7 @@ func TestTCPServerConcurrent(t *testing.T) {
 		go func(i int) {
 			defer wg.Done()
 			for j := 0; j < m; j++ {
-				conn, err := net.Dial("tcp", port)
+				conn, err := net.Dial("tcp", addr)
 				if err != nil {
 					select {
 					case errChan <- errors.New("failed to connect to server"):
@@ -112,3 +123,452 @@ func TestTCPServerConcurrent(t *testing.T) {
 		t.Fatalf("error occurred: %v", err)
 	}
 }
+
+func TestTCPClientDial(t *testing.T) {
+	stopchan := make(chan interface{})
+	addr := runServer(stopchan)
+	defer close(stopchan)
+
+	m := 100
+	n := 100
+	messageLength := 48
+
+	for i := 0; i < m; i++ {
+		connection, err := anet.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect to server: %v", err)
+		}
+		reader, writer := connection.Reader(), connection.Writer()
+
+		for j := 0; j < n; j++ {
+			message := anet.GetRandomString(messageLength-1) + "\n"
+			err = writer.WriteString(message, len(message))
+			if err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+			err = writer.Flush()
+			if err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+
+			response, err := reader.ReadUtil('\n')
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+
+			require.Equal(t, message, string(response))
+			reader.Release()
+		}
+
+		connection.Close()
+	}
+}
+
+func TestUnixServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anet.sock")
+	stopchan := make(chan interface{})
+	_ = runServerOn("unix", path, stopchan)
+	defer close(stopchan)
+
+	m := 100
+	n := 100
+	messageLength := 48
+
+	for i := 0; i < m; i++ {
+		connection, err := anet.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("failed to connect to server: %v", err)
+		}
+		reader, writer := connection.Reader(), connection.Writer()
+
+		for j := 0; j < n; j++ {
+			message := anet.GetRandomString(messageLength-1) + "\n"
+			err = writer.WriteString(message, len(message))
+			if err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+			err = writer.Flush()
+			if err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+
+			response, err := reader.ReadUtil('\n')
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+
+			require.Equal(t, message, string(response))
+			reader.Release()
+		}
+
+		connection.Close()
+	}
+}
+
+func TestTCPClientWriteDirect(t *testing.T) {
+	stopchan := make(chan interface{})
+	addr := runServer(stopchan)
+	defer close(stopchan)
+
+	connection, err := anet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	defer connection.Close()
+	reader, writer := connection.Reader(), connection.Writer()
+
+	// copied and direct blocks alternate, so one flush covers more chunks
+	// than a single sendmsg takes and has to continue across requests
+	m := 1500
+	var expected strings.Builder
+	for i := 0; i < m; i++ {
+		header := anet.GetRandomString(8)
+		body := []byte(anet.GetRandomString(64))
+		err = writer.WriteString(header, len(header))
+		if err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+		err = writer.WriteDirect(body)
+		if err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+		expected.WriteString(header)
+		expected.Write(body)
+	}
+	err = writer.WriteString("\n", 1)
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	expected.WriteString("\n")
+	err = writer.Flush()
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	response, err := reader.ReadUtil('\n')
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	require.Equal(t, expected.String(), string(response))
+	reader.Release()
+
+	// a large body is sent straight from the caller's slice
+	body := []byte(anet.GetRandomString(64*1024-1) + "\n")
+	err = writer.WriteDirect(body)
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	err = writer.Flush()
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	response, err = reader.ReadUtil('\n')
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	require.Equal(t, string(body), string(response))
+	reader.Release()
+}
+
+func TestTCPClientSendFile(t *testing.T) {
+	stopchan := make(chan interface{})
+	addr := runServer(stopchan)
+	defer close(stopchan)
+
+	// lines of lineLength bytes, so that every range of whole lines is
+	// echoed back as is
+	lines := 256
+	lineLength := 1024
+	var content []byte
+	for i := 0; i < lines; i++ {
+		content = append(content, anet.GetRandomString(lineLength-1)+"\n"...)
+	}
+	path := filepath.Join(t.TempDir(), "payload")
+	err := os.WriteFile(path, content, 0o644)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	connection, err := anet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	defer connection.Close()
+	reader, writer := connection.Reader(), connection.Writer()
+
+	expect := func(data []byte) {
+		response, err := reader.ReadBytes(len(data))
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		require.Equal(t, string(data), string(response))
+		reader.Release()
+	}
+
+	// pending output goes out ahead of the file
+	header := anet.GetRandomString(16)
+	err = writer.WriteString(header, len(header))
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	n, err := connection.SendFile(file, 0, -1)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), n)
+	expect(append([]byte(header), content...))
+
+	// a range in the middle of the file
+	offset := int64(3 * lineLength)
+	n, err = connection.SendFile(file, offset, int64(5*lineLength))
+	require.NoError(t, err)
+	require.Equal(t, int64(5*lineLength), n)
+	expect(content[offset : offset+n])
+
+	// a negative size runs up to the end of the file
+	offset = int64((lines - 2) * lineLength)
+	n, err = connection.SendFile(file, offset, -1)
+	require.NoError(t, err)
+	require.Equal(t, int64(2*lineLength), n)
+	expect(content[offset:])
+
+	// a size beyond the end of the file sends what there is
+	n, err = connection.SendFile(file, offset, int64(4*lineLength))
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, int64(2*lineLength), n)
+	expect(content[offset:])
+
+	n, err = connection.SendFile(file, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+
+	// the file offset is left alone
+	position, err := file.Seek(0, io.SeekCurrent)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), position)
+}
+
+func TestTCPClientReadTimeout(t *testing.T) {
+	stopchan := make(chan interface{})
+	addr := runServer(stopchan)
+	defer close(stopchan)
+
+	connection, err := anet.Dial("tcp", addr, anet.WithReadTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	defer connection.Close()
+	reader, writer := connection.Reader(), connection.Writer()
+
+	// the message has no delimiter, so the echo never completes a line
+	message := anet.GetRandomString(16)
+	err = writer.WriteString(message, len(message))
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	err = writer.Flush()
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	start := time.Now()
+	_, err = reader.ReadUtil('\n')
+	var timeoutErr *anet.TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Less(t, time.Since(start), time.Second)
+
+	_, err = reader.ReadBytes(1)
+	require.ErrorAs(t, err, &timeoutErr)
+}
+
+func TestTCPServerShutdown(t *testing.T) {
+	// serve starts an event loop whose handler reads one message, tells
+	// the test and hands it to respond, and returns the address it listens on
+	serve := func(respond func(ctx context.Context, connection anet.Connection, data []byte) error) (anet.EventLoop, string, chan struct{}) {
+		listener, err := anet.CreateListener("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = listener.Close()
+		})
+		started := make(chan struct{}, 1)
+		eventLoop, err := anet.NewEventLoop(func(ctx context.Context, connection anet.Connection) error {
+			data, err := connection.Reader().ReadUtil('\n')
+			if err != nil {
+				return err
+			}
+			started <- struct{}{}
+			return respond(ctx, connection, data)
+		})
+		require.NoError(t, err)
+		go func() {
+			_ = eventLoop.Serve(listener)
+		}()
+		return eventLoop, listener.Addr().String(), started
+	}
+
+	t.Run("SlowHandler", func(t *testing.T) {
+		eventLoop, addr, started := serve(func(ctx context.Context, connection anet.Connection, data []byte) error {
+			time.Sleep(300 * time.Millisecond)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			writer := connection.Writer()
+			err := writer.WriteBytes(data, len(data))
+			if err != nil {
+				return err
+			}
+			return writer.Flush()
+		})
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		message := anet.GetRandomString(47) + "\n"
+		_, err = conn.Write([]byte(message))
+		require.NoError(t, err)
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown := make(chan error, 1)
+		go func() {
+			shutdown <- eventLoop.Shutdown(ctx)
+		}()
+		// the handler finishes its request while the event loop shuts down,
+		// and is not called again afterwards
+		reader := bufio.NewReader(conn)
+		response, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, message, response)
+		_, err = reader.ReadString('\n')
+		require.ErrorIs(t, err, io.EOF)
+		require.NoError(t, <-shutdown)
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		cancelled := make(chan error, 1)
+		eventLoop, addr, started := serve(func(ctx context.Context, connection anet.Connection, data []byte) error {
+			<-ctx.Done()
+			cancelled <- ctx.Err()
+			return ctx.Err()
+		})
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("stuck\n"))
+		require.NoError(t, err)
+		<-started
+
+		// the handler context is only cancelled once the deadline passed
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		err = eventLoop.Shutdown(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		select {
+		case err = <-cancelled:
+			require.ErrorIs(t, err, context.Canceled)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler context was not cancelled")
+		}
+	})
+}
+
+func TestTCPServerTLS(t *testing.T) {
+	serverConfig, clientConfig := selfSignedTLS(t)
+	listener, err := anet.CreateListener("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	eventLoop, err := anet.NewEventLoop(handleConnection, anet.WithTLSConfig(serverConfig))
+	require.NoError(t, err)
+	go func() {
+		_ = eventLoop.Serve(listener)
+	}()
+	defer func() {
+		_ = eventLoop.Shutdown(context.Background())
+		_ = listener.Close()
+	}()
+
+	connection, err := anet.Dial("tcp", addr, anet.WithTLSConfig(clientConfig), anet.WithReadTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	defer connection.Close()
+	tlsConnection, ok := connection.(anet.TLSConnection)
+	require.True(t, ok)
+	require.True(t, tlsConnection.ConnectionState().HandshakeComplete)
+	echo(t, connection, 10, 48)
+	echo(t, connection, 2, 64*1024)
+
+	// the read timeout bounds every read of the record layer
+	start := time.Now()
+	_, err = connection.Reader().ReadUtil('\n')
+	var timeoutErr *anet.TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	require.Less(t, time.Since(start), 2*time.Second)
+
+	// the server is not stopped by the timed out client
+	connection, err = anet.Dial("tcp", addr, anet.WithTLSConfig(clientConfig))
+	if err != nil {
+		t.Fatalf("failed to connect to server: %v", err)
+	}
+	echo(t, connection, 1, 48)
+	require.NoError(t, connection.Close())
+}
+
+// echo sends m messages of messageLength bytes over connection, which is
+// served by handleConnection, and checks that each of them comes back.
+func echo(t *testing.T, connection anet.Connection, m, messageLength int) {
+	t.Helper()
+	reader, writer := connection.Reader(), connection.Writer()
+	for i := 0; i < m; i++ {
+		message := anet.GetRandomString(messageLength-1) + "\n"
+		err := writer.WriteString(message, len(message))
+		if err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+		err = writer.Flush()
+		if err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+
+		response, err := reader.ReadUtil('\n')
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+
+		require.Equal(t, message, string(response))
+		reader.Release()
+	}
+}
+
+// selfSignedTLS returns a server config with a self-signed certificate for
+// localhost and a client config that trusts it.
+func selfSignedTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	clientConfig := &tls.Config{
+		RootCAs:    roots,
+		ServerName: "localhost",
+	}
+	return serverConfig, clientConfig
+}
@@ -0,0 +1,33 @@
+package udpserver
+
+import (
+	"context"
+	"net"
+
+	"github.com/zjregee/anet"
+)
+
+func runServer(port string, stopChan chan interface{}) {
+	connection, err := anet.ListenPacket("udp", port)
+	if err != nil {
+		panic("shouldn't failed here")
+	}
+
+	eventLoop, err := anet.NewEventLoop(nil, anet.WithOnPacket(handlePacket))
+	if err != nil {
+		panic("shouldn't failed here")
+	}
+	go func() {
+		_ = eventLoop.ServePacket(connection)
+	}()
+
+	go func() {
+		<-stopChan
+		_ = eventLoop.Shutdown(context.Background())
+	}()
+}
+
+func handlePacket(_ context.Context, connection anet.PacketConnection, data []byte, addr net.Addr) error {
+	_, err := connection.WriteTo(data, addr)
+	return err
+}
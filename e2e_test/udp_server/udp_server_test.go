@@ -0,0 +1,47 @@
+package udpserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zjregee/anet"
+)
+
+func TestUDPServerSerial(t *testing.T) {
+	port := ":8101"
+	stopchan := make(chan interface{})
+	runServer(port, stopchan)
+	defer close(stopchan)
+
+	m := 100
+	n := 100
+	messageLength := 48
+
+	for i := 0; i < m; i++ {
+		conn, err := net.Dial("udp", port)
+		if err != nil {
+			t.Fatalf("failed to connect to server: %v", err)
+		}
+
+		buffer := make([]byte, messageLength)
+		for j := 0; j < n; j++ {
+			message := anet.GetRandomString(messageLength)
+			_, err = conn.Write([]byte(message))
+			if err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			k, err := conn.Read(buffer)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+
+			require.Equal(t, message, string(buffer[:k]))
+		}
+
+		conn.Close()
+	}
+}
@@ -0,0 +1,28 @@
+package anet
+
+import "errors"
+
+var (
+	ErrConnClosed          = errors.New("connection has been closed")
+	ErrEventLoopClosed     = errors.New("eventloop has been shut down")
+	ErrNoPacketHandler     = errors.New("eventloop has no OnPacket callback")
+	ErrUnsupportedListener = errors.New("listener does not expose a file descriptor")
+)
+
+// TimeoutError is returned when an operation on a connection did not finish
+// within the read or write timeout of the connection.
+type TimeoutError struct {
+	Op string
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Op + " timed out"
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
@@ -0,0 +1,194 @@
+package anet
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds of the latency histogram unless
+// others are given to WithLatencyHistogram.
+var DefaultLatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// EventLoopStats is a snapshot of the counters of an event loop, connections
+// created with Dial are not counted.
+type EventLoopStats struct {
+	Id           string
+	Accepted     uint64
+	Active       int
+	Closed       uint64
+	BytesRead    uint64
+	BytesWritten uint64
+	// nil unless the event loop was created with WithLatencyHistogram, as
+	// are the histograms of the open connections
+	Latency     *LatencyHistogram
+	Connections []ConnectionStats
+}
+
+// ConnectionStats holds the latency histogram of one open connection.
+type ConnectionStats struct {
+	ConnectionID string
+	Latency      *LatencyHistogram
+}
+
+// LatencyHistogram counts the calls of OnRequest by the time they took.
+// Counts[i] holds the calls that took at most Buckets[i] and longer than the
+// bucket before, the last entry of Counts those that took longer than every
+// bucket.
+type LatencyHistogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+// loopStats collects the counters of an event loop, its connections share it.
+type loopStats struct {
+	accepted     uint64
+	closed       uint64
+	bytesRead    uint64
+	bytesWritten uint64
+	latency      *latencyHistogram
+}
+
+type latencyHistogram struct {
+	buckets []time.Duration
+	counts  []uint64
+	sum     int64
+}
+
+func newLatencyHistogram(buckets []time.Duration) *latencyHistogram {
+	buckets = append([]time.Duration(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	return &latencyHistogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// empty returns a histogram with the same buckets and nothing counted.
+func (h *latencyHistogram) empty() *latencyHistogram {
+	return &latencyHistogram{
+		buckets: h.buckets,
+		counts:  make([]uint64, len(h.counts)),
+	}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	index := sort.Search(len(h.buckets), func(i int) bool { return d <= h.buckets[i] })
+	atomic.AddUint64(&h.counts[index], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *latencyHistogram) snapshot() *LatencyHistogram {
+	histogram := &LatencyHistogram{
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.counts)),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	for i := range h.counts {
+		histogram.Counts[i] = atomic.LoadUint64(&h.counts[i])
+		histogram.Count += histogram.Counts[i]
+	}
+	return histogram
+}
+
+// NewMetricsHandler serves the counters of the rings of the ring manager and of
+// the given event loops in the Prometheus text format. The histograms of single
+// connections are left out, a label per connection would grow without bound,
+// they are only found in EventLoopStats.Connections.
+func NewMetricsHandler(loops ...EventLoop) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		loopStats := make([]EventLoopStats, 0, len(loops))
+		for _, loop := range loops {
+			loopStats = append(loopStats, loop.Stats())
+		}
+		bw := bufio.NewWriter(w)
+		writeRingMetrics(bw, GetRingManager().Stats())
+		writeLoopMetrics(bw, loopStats)
+		_ = bw.Flush()
+	})
+}
+
+func writeRingMetrics(w *bufio.Writer, stats []RingStats) {
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(s *RingStats) float64
+	}{
+		{"anet_ring_sqes_submitted_total", "counter", "Submission queue entries submitted.", func(s *RingStats) float64 { return float64(s.Submitted) }},
+		{"anet_ring_cqes_handled_total", "counter", "Completion queue entries handled.", func(s *RingStats) float64 { return float64(s.Completed) }},
+		{"anet_ring_submit_batches_total", "counter", "Batches of requests submitted.", func(s *RingStats) float64 { return float64(s.Batches) }},
+		{"anet_ring_eagain_retries_total", "counter", "Requests retried after EAGAIN.", func(s *RingStats) float64 { return float64(s.Retries) }},
+		{"anet_ring_pending_ops", "gauge", "Requests waiting for their final completion.", func(s *RingStats) float64 { return float64(s.Pending) }},
+		{"anet_ring_operators", "gauge", "Operators registered on the ring.", func(s *RingStats) float64 { return float64(s.Operators) }},
+	}
+	for _, metric := range metrics {
+		writeHeader(w, metric.name, metric.kind, metric.help)
+		for i := range stats {
+			fmt.Fprintf(w, "%s{ring=%q} %v\n", metric.name, stats[i].Id, metric.value(&stats[i]))
+		}
+	}
+}
+
+func writeLoopMetrics(w *bufio.Writer, stats []EventLoopStats) {
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(s *EventLoopStats) float64
+	}{
+		{"anet_connections_accepted_total", "counter", "Connections accepted.", func(s *EventLoopStats) float64 { return float64(s.Accepted) }},
+		{"anet_connections_active", "gauge", "Connections currently open.", func(s *EventLoopStats) float64 { return float64(s.Active) }},
+		{"anet_connections_closed_total", "counter", "Connections closed.", func(s *EventLoopStats) float64 { return float64(s.Closed) }},
+		{"anet_read_bytes_total", "counter", "Bytes read from connections.", func(s *EventLoopStats) float64 { return float64(s.BytesRead) }},
+		{"anet_written_bytes_total", "counter", "Bytes written to connections.", func(s *EventLoopStats) float64 { return float64(s.BytesWritten) }},
+	}
+	for _, metric := range metrics {
+		writeHeader(w, metric.name, metric.kind, metric.help)
+		for i := range stats {
+			fmt.Fprintf(w, "%s{loop=%q} %v\n", metric.name, stats[i].Id, metric.value(&stats[i]))
+		}
+	}
+	header := false
+	for _, s := range stats {
+		if s.Latency == nil {
+			continue
+		}
+		if !header {
+			writeHeader(w, "anet_request_duration_seconds", "histogram", "Time spent in OnRequest.")
+			header = true
+		}
+		writeHistogram(w, "anet_request_duration_seconds", fmt.Sprintf("loop=%q", s.Id), s.Latency)
+	}
+}
+
+func writeHistogram(w *bufio.Writer, name, labels string, h *LatencyHistogram) {
+	var cumulative uint64
+	for i, bucket := range h.Buckets {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%v\"} %d\n", name, labels, bucket.Seconds(), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.Count)
+	fmt.Fprintf(w, "%s_sum{%s} %v\n", name, labels, h.Sum.Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.Count)
+}
+
+func writeHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
@@ -0,0 +1,97 @@
+package anet
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLoopStats(t *testing.T) {
+	// one message per call, so that every request is timed on its own
+	eventLoop, addr := serveLoop(t, handleMessage, WithLatencyHistogram())
+
+	messageLength := 48
+	// each connection sends its own number of messages, so that their
+	// histograms tell them apart
+	counts := []int{100, 10}
+	m := sum(counts)
+
+	var conns []net.Conn
+	for _, count := range counts {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		reader := bufio.NewReader(conn)
+		for i := 0; i < count; i++ {
+			message := GetRandomString(messageLength-1) + "\n"
+			_, err = conn.Write([]byte(message))
+			require.NoError(t, err)
+			response, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			require.Equal(t, message, response)
+		}
+		conns = append(conns, conn)
+	}
+	require.Equal(t, len(counts), eventLoop.Stats().Active)
+	// a call is timed once it has returned, which may be after the client
+	// read the response
+	require.Eventually(t, func() bool {
+		stats := eventLoop.Stats()
+		var timed []int
+		for _, connection := range stats.Connections {
+			timed = append(timed, int(connection.Latency.Count))
+		}
+		slices.Sort(timed)
+		return slices.Equal(timed, []int{10, 100}) && stats.Latency.Count == uint64(m)
+	}, time.Second, time.Millisecond)
+	recorder := httptest.NewRecorder()
+	NewMetricsHandler(eventLoop).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	// only the histogram of the event loop is exported, one per connection
+	// would add series without bound
+	require.Contains(t, body, "# TYPE anet_request_duration_seconds histogram")
+	require.Contains(t, body, fmt.Sprintf("anet_request_duration_seconds_count{loop=%q} %d\n", eventLoop.Stats().Id, m))
+	require.NotContains(t, body, "connection=")
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	require.Eventually(t, func() bool {
+		return eventLoop.Stats().Closed == uint64(len(counts))
+	}, time.Second, 10*time.Millisecond)
+	stats := eventLoop.Stats()
+	require.Equal(t, uint64(len(counts)), stats.Accepted)
+	require.Equal(t, 0, stats.Active)
+	require.Empty(t, stats.Connections)
+	require.Equal(t, uint64(m*messageLength), stats.BytesRead)
+	require.Equal(t, uint64(m*messageLength), stats.BytesWritten)
+	require.NotNil(t, stats.Latency)
+	// the calls that run into the end of the stream are timed as well
+	require.Equal(t, uint64(m+len(counts)), stats.Latency.Count)
+	require.Len(t, stats.Latency.Counts, len(DefaultLatencyBuckets)+1)
+
+	var submitted, completed uint64
+	for _, ring := range GetRingManager().Stats() {
+		submitted += ring.Submitted
+		completed += ring.Completed
+		require.GreaterOrEqual(t, ring.Pending, int64(0))
+	}
+	require.Greater(t, submitted, uint64(0))
+	require.Greater(t, completed, uint64(0))
+
+	recorder = httptest.NewRecorder()
+	NewMetricsHandler(eventLoop).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body = recorder.Body.String()
+	require.Contains(t, body, "# TYPE anet_ring_sqes_submitted_total counter")
+	require.Contains(t, body, "# TYPE anet_ring_pending_ops gauge")
+	require.Contains(t, body, fmt.Sprintf("anet_connections_accepted_total{loop=%q} %d\n", stats.Id, len(counts)))
+	require.Contains(t, body, fmt.Sprintf("anet_read_bytes_total{loop=%q} %d\n", stats.Id, m*messageLength))
+	require.Contains(t, body, fmt.Sprintf("anet_request_duration_seconds_count{loop=%q} %d\n", stats.Id, m+len(counts)))
+	require.Contains(t, body, fmt.Sprintf("anet_request_duration_seconds_bucket{loop=%q,le=\"+Inf\"} %d\n", stats.Id, m+len(counts)))
+	require.NotContains(t, body, "anet_connection_request_duration_seconds")
+}
@@ -0,0 +1,45 @@
+package anet
+
+import (
+	"net"
+	"time"
+)
+
+// Observer is told about what happens on the connections accepted by an event
+// loop, it is set with WithObserver. OnRead and OnWrite run on the completion
+// goroutine of the ring and must not block.
+type Observer interface {
+	OnAccept(info ConnInfo, raddr net.Addr)
+	// n is zero if err is set. latency is the time from the submission of
+	// the request to its completion, for a multishot receive the time since
+	// the completion before
+	OnRead(info ConnInfo, n int, err error, latency time.Duration)
+	OnWrite(info ConnInfo, n int, err error, latency time.Duration)
+	// op is the operation that timed out: read, write, sendfile or idle
+	OnTimeout(info ConnInfo, op string)
+	// reason is the error that ended the handler, ErrEventLoopClosed on
+	// shutdown and nil if Close was called on the connection
+	OnClose(info ConnInfo, reason error)
+}
+
+// ConnInfo identifies the connection an observed event belongs to.
+type ConnInfo struct {
+	ConnectionID string
+	// the ring the operator of the connection is registered on, which may
+	// change when the ring manager is resized
+	RingID string
+}
+
+// NopObserver ignores every event, embed it to implement only some of the
+// methods of Observer.
+type NopObserver struct{}
+
+func (NopObserver) OnAccept(info ConnInfo, raddr net.Addr) {}
+
+func (NopObserver) OnRead(info ConnInfo, n int, err error, latency time.Duration) {}
+
+func (NopObserver) OnWrite(info ConnInfo, n int, err error, latency time.Duration) {}
+
+func (NopObserver) OnTimeout(info ConnInfo, op string) {}
+
+func (NopObserver) OnClose(info ConnInfo, reason error) {}
@@ -0,0 +1,121 @@
+package anet
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingObserver struct {
+	NopObserver
+	mu        sync.Mutex
+	infos     []ConnInfo
+	raddr     net.Addr
+	bytesRead int
+	written   int
+	// n of the reads and writes that failed
+	failed   []int
+	timeouts []string
+	closed   chan error
+}
+
+func (o *recordingObserver) record(info ConnInfo) {
+	o.infos = append(o.infos, info)
+}
+
+func (o *recordingObserver) OnAccept(info ConnInfo, raddr net.Addr) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.record(info)
+	o.raddr = raddr
+}
+
+func (o *recordingObserver) OnRead(info ConnInfo, n int, err error, latency time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.record(info)
+	o.bytesRead += n
+	if err != nil {
+		o.failed = append(o.failed, n)
+	}
+}
+
+func (o *recordingObserver) OnWrite(info ConnInfo, n int, err error, latency time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.record(info)
+	o.written += n
+	if err != nil {
+		o.failed = append(o.failed, n)
+	}
+}
+
+func (o *recordingObserver) OnTimeout(info ConnInfo, op string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.record(info)
+	o.timeouts = append(o.timeouts, op)
+}
+
+func (o *recordingObserver) OnClose(info ConnInfo, reason error) {
+	o.mu.Lock()
+	o.record(info)
+	o.mu.Unlock()
+	o.closed <- reason
+}
+
+func TestObserver(t *testing.T) {
+	observer := &recordingObserver{closed: make(chan error, 1)}
+	_, addr := serveLoop(t, handleMessage, WithObserver(observer), WithReadTimeout(200*time.Millisecond))
+
+	m := 10
+	messageLength := 48
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for i := 0; i < m; i++ {
+		message := GetRandomString(messageLength-1) + "\n"
+		_, err = conn.Write([]byte(message))
+		require.NoError(t, err)
+		response, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, message, response)
+	}
+
+	// the client goes quiet, so the next read of the handler times out and
+	// the connection is closed with that error
+	var reason error
+	select {
+	case reason = <-observer.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection was not closed")
+	}
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, reason, &timeoutErr)
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	require.Equal(t, conn.LocalAddr().String(), observer.raddr.String())
+	require.Equal(t, m*messageLength, observer.bytesRead)
+	require.Equal(t, m*messageLength, observer.written)
+	require.Contains(t, observer.timeouts, "read")
+	// the timed out read is reported without a negative count
+	require.NotEmpty(t, observer.failed)
+	for _, n := range observer.failed {
+		require.Zero(t, n)
+	}
+	rings := make(map[string]bool)
+	for _, ring := range GetRingManager().Stats() {
+		rings[ring.Id] = true
+	}
+	for _, info := range observer.infos {
+		require.Equal(t, observer.infos[0].ConnectionID, info.ConnectionID)
+		require.True(t, rings[info.RingID])
+	}
+}
@@ -1,17 +1,190 @@
 package anet
 
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// states of a migration to another ring
+const (
+	migrateNone    = 0
+	migrateWaiting = 1
+	migrateMoving  = 2
+)
+
 type FDOperator struct {
-	FD      int
-	OnRead  func(n int, err error)
-	OnWrite func(n int, err error)
-	Ring    Ring
+	FD        int
+	OnRead    func(n int, err error)
+	OnWrite   func(n int, err error)
+	OnConnect func(err error)
+	OnAccept  func(fd int, more bool, err error)
+	OnSplice  func(n int, err error)
+	// OnReadBuffer receives data read into a ring provided buffer, bid has to
+	// be handed back through Ring.RecycleBuffer once data is consumed and is
+	// -1 when no buffer was picked. more reports whether a multishot receive
+	// keeps producing completions.
+	OnReadBuffer func(data []byte, bid int, more bool, err error)
+	Ring         Ring
+
+	inflight int32
+	draining int32
+	onDrain  func()
+	// the last request submitted on the read and on the write side, at most
+	// one of each is in flight. A migration cancels them and submits them
+	// again on the new ring.
+	events    [2]int32
+	requests  [2]RingEventData
+	migrating int32
+	mu        sync.Mutex
+	target    Ring
+	parked    []RingEventData
+}
+
+// requestSide returns the index into FDOperator.requests of event.
+func requestSide(event RingEvent) int {
+	switch event {
+	case RingPrepRead, RingPrepRecv, RingPrepRecvMsg, RingPrepAccept:
+		return 0
+	default:
+		return 1
+	}
 }
 
 func (op *FDOperator) Submit(eventData RingEventData) {
+	atomic.AddInt32(&op.inflight, 1)
+	if atomic.LoadInt32(&op.draining) != 0 {
+		op.Done()
+		return
+	}
 	eventData.Operator = op
+	side := requestSide(eventData.Event)
+	op.requests[side] = eventData
+	atomic.StoreInt32(&op.events[side], int32(eventData.Event))
+	op.route(eventData)
+}
+
+// route hands a counted request to the ring. Requests submitted while the
+// operator migrates are parked and follow it to the new ring.
+func (op *FDOperator) route(eventData RingEventData) {
+	if atomic.LoadInt32(&op.migrating) != migrateNone {
+		op.mu.Lock()
+		if atomic.LoadInt32(&op.migrating) != migrateNone {
+			op.parked = append(op.parked, eventData)
+			op.mu.Unlock()
+			op.Done()
+			return
+		}
+		op.mu.Unlock()
+	}
 	op.Ring.Submit(eventData)
 }
 
+// Drain cancels every request in flight on the fd and stops accepting new
+// ones, onDrain runs once the last of their completions has been delivered.
+func (op *FDOperator) Drain(onDrain func()) {
+	// the cancel request holds the count up until the operator is draining
+	atomic.AddInt32(&op.inflight, 1)
+	op.onDrain = onDrain
+	atomic.StoreInt32(&op.draining, 1)
+	op.route(RingEventData{Event: RingPrepCancel, Operator: op})
+}
+
+// Migrate moves the operator over to ring once its requests in flight have
+// completed. They are cancelled for that, except for a connect, and follow
+// the operator to the new ring. It does nothing if the operator is already
+// migrating or draining.
+func (op *FDOperator) Migrate(ring Ring) {
+	// the count is held so that the operator cannot move before the cancel
+	// has been submitted
+	atomic.AddInt32(&op.inflight, 1)
+	defer op.Done()
+	op.mu.Lock()
+	if atomic.LoadInt32(&op.draining) != 0 || atomic.LoadInt32(&op.migrating) != migrateNone || ring == op.Ring {
+		op.mu.Unlock()
+		return
+	}
+	from := op.Ring
+	op.target = ring
+	atomic.StoreInt32(&op.migrating, migrateWaiting)
+	op.mu.Unlock()
+	for i := range op.events {
+		event := RingEvent(atomic.LoadInt32(&op.events[i]))
+		if event == 0 || event == RingPrepConnect {
+			continue
+		}
+		// a cancel of a request that has completed meanwhile finds nothing
+		op.cancel(from, event)
+		switch event {
+		case RingPrepWrite:
+			op.cancel(from, RingPrepSendZC)
+		case RingPrepSendMsg:
+			op.cancel(from, RingPrepSendMsgZC)
+		}
+	}
+}
+
+func (op *FDOperator) cancel(ring Ring, event RingEvent) {
+	atomic.AddInt32(&op.inflight, 1)
+	ring.Submit(RingEventData{Event: RingPrepCancel, CancelEvent: event, Operator: op})
+}
+
+// requeue parks the request of event that completed with ECANCELED if a
+// migration has cancelled it, the request is then submitted to the new ring
+// instead of being completed.
+func (op *FDOperator) requeue(event RingEvent) bool {
+	if atomic.LoadInt32(&op.migrating) != migrateWaiting || atomic.LoadInt32(&op.draining) != 0 {
+		return false
+	}
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if atomic.LoadInt32(&op.migrating) != migrateWaiting {
+		return false
+	}
+	op.parked = append(op.parked, op.requests[requestSide(event)])
+	return true
+}
+
+// Done is called by the ring once a request has produced its last completion.
+func (op *FDOperator) Done() {
+	if atomic.AddInt32(&op.inflight, -1) != 0 {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&op.migrating, migrateWaiting, migrateMoving) {
+		// the parked requests are handed over while the count is held
+		atomic.AddInt32(&op.inflight, 1)
+		op.move()
+		op.Done()
+		return
+	}
+	if atomic.CompareAndSwapInt32(&op.draining, 1, 2) {
+		op.onDrain()
+	}
+}
+
+func (op *FDOperator) move() {
+	op.mu.Lock()
+	op.Ring.Unregister(op)
+	op.Ring = op.target
+	op.Ring.Register(op)
+	op.target = nil
+	parked := op.parked
+	op.parked = nil
+	atomic.StoreInt32(&op.migrating, migrateNone)
+	op.mu.Unlock()
+	for _, eventData := range parked {
+		atomic.AddInt32(&op.inflight, 1)
+		op.Ring.Submit(eventData)
+	}
+}
+
+// ringID returns the id of the ring the operator is registered on, which
+// changes when it migrates.
+func (op *FDOperator) ringID() string {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.Ring.Id()
+}
+
 func (op *FDOperator) Register() {
 	op.Ring.Register(op)
 }
@@ -24,5 +197,17 @@ func (op *FDOperator) Reset() {
 	op.FD = 0
 	op.OnRead = nil
 	op.OnWrite = nil
+	op.OnConnect = nil
+	op.OnAccept = nil
+	op.OnSplice = nil
+	op.OnReadBuffer = nil
 	op.Ring = nil
+	op.inflight = 0
+	op.draining = 0
+	op.onDrain = nil
+	op.events = [2]int32{}
+	op.requests = [2]RingEventData{}
+	op.migrating = 0
+	op.target = nil
+	op.parked = nil
 }
@@ -0,0 +1,146 @@
+package anet
+
+import (
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOperatorDrainCancelsPendingRead(t *testing.T) {
+	m := newTestRingManager(t)
+	ring := m.Pick(nil).(*defaultRing)
+	defer ring.Close()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[1])
+	var reads []error
+	op := ring.Alloc()
+	op.FD = fds[0]
+	op.OnRead = func(n int, err error) {
+		reads = append(reads, err)
+	}
+	op.Ring = ring
+	op.Register()
+	require.Equal(t, 1, ring.Load())
+
+	// the read waits for data that never comes until the drain cancels it
+	buf := make([]byte, 16)
+	op.Submit(RingEventData{Event: RingPrepRead, Data: buf, Size: len(buf)})
+	drained := make(chan []error, 1)
+	op.Drain(func() {
+		// only now no completion refers to the fd anymore
+		drained <- append([]error(nil), reads...)
+		op.Free()
+		_ = syscall.Close(fds[0])
+	})
+	select {
+	case errs := <-drained:
+		require.Equal(t, []error{syscall.ECANCELED}, errs)
+	case <-time.After(time.Second):
+		t.Fatalf("operator did not drain")
+	}
+	require.Equal(t, 0, ring.Load())
+	require.Nil(t, ring.getOperator(fds[0]))
+	require.Eventually(t, func() bool {
+		return ring.Stats().Pending == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestOperatorDrainIdle(t *testing.T) {
+	m := newTestRingManager(t, WithRingNum(1))
+	ring := m.Pick(nil).(*defaultRing)
+	defer ring.Close()
+
+	fds := make([]int, 2)
+	require.NoError(t, syscall.Pipe2(fds, syscall.O_CLOEXEC))
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	var reads, drains int32
+	op := ring.Alloc()
+	op.FD = fds[0]
+	op.OnRead = func(n int, err error) {
+		atomic.AddInt32(&reads, 1)
+	}
+	op.Ring = ring
+	op.Register()
+
+	drained := make(chan struct{})
+	op.Drain(func() {
+		atomic.AddInt32(&drains, 1)
+		close(drained)
+	})
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatalf("operator did not drain")
+	}
+
+	// requests submitted after the drain are dropped without a completion
+	_, err := syscall.Write(fds[1], []byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 16)
+	op.Submit(RingEventData{Event: RingPrepRead, Data: buf, Size: len(buf)})
+	time.Sleep(10 * time.Millisecond)
+	require.Zero(t, atomic.LoadInt32(&reads))
+	require.Equal(t, int32(1), atomic.LoadInt32(&drains))
+	require.Zero(t, atomic.LoadInt32(&op.inflight))
+	op.Free()
+}
+
+func TestOperatorReset(t *testing.T) {
+	m := newTestRingManager(t, WithRingNum(1))
+	ring := m.Pick(nil).(*defaultRing)
+	defer ring.Close()
+
+	op := ring.Alloc()
+	op.FD = 1 << 20
+	op.OnRead = func(n int, err error) {}
+	op.Ring = ring
+	op.Register()
+	op.requests[0] = RingEventData{Event: RingPrepRead, Operator: op}
+	op.events[0] = int32(RingPrepRead)
+	op.parked = []RingEventData{{Event: RingPrepRead, Operator: op}}
+	op.draining = 2
+	op.Free()
+
+	// a freed operator goes back to the pool as good as new
+	require.Nil(t, ring.getOperator(1<<20))
+	require.Zero(t, op.FD)
+	require.Nil(t, op.OnRead)
+	require.Nil(t, op.Ring)
+	require.Zero(t, op.draining)
+	require.Equal(t, [2]int32{}, op.events)
+	require.Equal(t, [2]RingEventData{}, op.requests)
+	require.Nil(t, op.parked)
+}
+
+func freeOperator(op *FDOperator) {
+	drained := make(chan struct{})
+	op.Drain(func() {
+		op.Free()
+		close(drained)
+	})
+	<-drained
+}
+
+func TestRingDropsCompletionOfUnregisteredFD(t *testing.T) {
+	m := newTestRingManager(t, WithRingNum(1))
+	ring := m.Pick(nil).(*defaultRing)
+	defer ring.Close()
+
+	// a completion whose operator is already gone must not reach it
+	atomic.AddInt64(&ring.pending, 1)
+	ring.handleEvent(encodeUserData(RingPrepRead, 1<<20), 4, 0)
+	require.Zero(t, ring.Stats().Pending)
+
+	// one of a multishot request that keeps going leaves it pending
+	atomic.AddInt64(&ring.pending, 1)
+	ring.handleEvent(encodeUserData(RingPrepRecv, 1<<20), 4, cqeFMore)
+	require.Equal(t, int64(1), ring.Stats().Pending)
+	ring.handleEvent(encodeUserData(RingPrepRecv, 1<<20), 0, 0)
+	require.Zero(t, ring.Stats().Pending)
+}
@@ -0,0 +1,221 @@
+package anet
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/google/uuid"
+)
+
+const maxPacketSize = 65536
+
+type PacketConnection interface {
+	ID() string
+	LocalAddr() net.Addr
+	ReadFrom(p []byte) (int, net.Addr, error)
+	WriteTo(p []byte, addr net.Addr) (int, error)
+	Close() error
+}
+
+type OnPacket func(ctx context.Context, connection PacketConnection, data []byte, addr net.Addr) error
+
+func ListenPacket(network, addr string) (PacketConnection, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if udpAddr.IP == nil {
+		if network == "udp6" {
+			udpAddr.IP = net.IPv6zero
+		} else {
+			udpAddr.IP = net.IPv4zero
+		}
+	}
+	sockaddr, family := sockaddrFromUDPAddr(udpAddr)
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(&sockaddr[0])), uintptr(len(sockaddr)))
+	if errno != 0 {
+		_ = syscall.Close(fd)
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: udpAddr, Err: os.NewSyscallError("bind", errno)}
+	}
+	connection := &packetConnection{}
+	connection.init(fd)
+	return connection, nil
+}
+
+type packetResult struct {
+	n   int
+	err error
+}
+
+type packetConnection struct {
+	id           string
+	fd           int
+	laddr        net.Addr
+	operator     *FDOperator
+	readTrigger  chan packetResult
+	writeTrigger chan packetResult
+	readMu       sync.Mutex
+	writeMu      sync.Mutex
+	readMsg      syscall.Msghdr
+	readIovec    syscall.Iovec
+	readName     syscall.RawSockaddrAny
+	writeMsg     syscall.Msghdr
+	writeIovec   syscall.Iovec
+	state        int32 // 0: connected, 1: closed
+}
+
+var _ PacketConnection = &packetConnection{}
+
+func (c *packetConnection) ID() string {
+	return c.id
+}
+
+func (c *packetConnection) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *packetConnection) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.isClosed() {
+		return 0, nil, ErrConnClosed
+	}
+	if len(p) == 0 {
+		return 0, nil, nil
+	}
+
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(&p[0])
+	pinner.Pin(&c.readIovec)
+	pinner.Pin(&c.readName)
+	c.readIovec.Base = &p[0]
+	c.readIovec.SetLen(len(p))
+	c.readMsg = syscall.Msghdr{}
+	c.readMsg.Name = (*byte)(unsafe.Pointer(&c.readName))
+	c.readMsg.Namelen = syscall.SizeofSockaddrAny
+	c.readMsg.Iov = &c.readIovec
+	c.readMsg.Iovlen = 1
+
+	eventData := RingEventData{}
+	eventData.Event = RingPrepRecvMsg
+	eventData.Msg = &c.readMsg
+	c.operator.Submit(eventData)
+	result := <-c.readTrigger
+	// a receive ended by Close may fail with ECANCELED
+	if c.isClosed() {
+		return 0, nil, ErrConnClosed
+	}
+	if result.err != nil {
+		return 0, nil, result.err
+	}
+	return result.n, udpAddrFromSockaddr(&c.readName), nil
+}
+
+func (c *packetConnection) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: syscall.EINVAL}
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.isClosed() {
+		return 0, ErrConnClosed
+	}
+
+	sockaddr, _ := sockaddrFromUDPAddr(udpAddr)
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(&sockaddr[0])
+	pinner.Pin(&c.writeIovec)
+	if len(p) > 0 {
+		pinner.Pin(&p[0])
+		c.writeIovec.Base = &p[0]
+	}
+	c.writeIovec.SetLen(len(p))
+	c.writeMsg = syscall.Msghdr{}
+	c.writeMsg.Name = &sockaddr[0]
+	c.writeMsg.Namelen = uint32(len(sockaddr))
+	c.writeMsg.Iov = &c.writeIovec
+	c.writeMsg.Iovlen = 1
+
+	eventData := RingEventData{}
+	eventData.Event = RingPrepSendMsg
+	eventData.Msg = &c.writeMsg
+	c.operator.Submit(eventData)
+	result := <-c.writeTrigger
+	return result.n, result.err
+}
+
+func (c *packetConnection) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.state, 0, 1) {
+		return nil
+	}
+	// shutting the socket down completes the pending receive, after which
+	// no request owned by the ring references this connection any more
+	_ = syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+	c.readMu.Lock()
+	c.writeMu.Lock()
+	defer c.readMu.Unlock()
+	defer c.writeMu.Unlock()
+	c.operator.Drain(c.release)
+	return nil
+}
+
+func (c *packetConnection) release() {
+	c.operator.Free()
+	err := syscall.Close(c.fd)
+	if err != nil {
+		log.Warnf("[packet connection %s] failed to close fd: %s", c.id, err.Error())
+	}
+}
+
+func (c *packetConnection) init(fd int) {
+	c.fd = fd
+
+	ring := GetRingManager().Pick(nil)
+	op := ring.Alloc()
+	op.FD = c.fd
+	op.OnRead = c.onRead
+	op.OnWrite = c.onWrite
+	op.Ring = ring
+	op.Register()
+	c.operator = op
+
+	c.state = 0
+	c.id = uuid.New().String()[:8]
+	c.readTrigger = make(chan packetResult, 1)
+	c.writeTrigger = make(chan packetResult, 1)
+	if sa, err := syscall.Getsockname(fd); err == nil {
+		if addr, ok := netAddrFromSockaddr(sa).(*net.TCPAddr); ok {
+			c.laddr = &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+		}
+	}
+}
+
+func (c *packetConnection) isClosed() bool {
+	return atomic.LoadInt32(&c.state) != 0
+}
+
+func (c *packetConnection) onRead(n int, err error) {
+	c.readTrigger <- packetResult{n: n, err: err}
+}
+
+func (c *packetConnection) onWrite(n int, err error) {
+	c.writeTrigger <- packetResult{n: n, err: err}
+}
@@ -1,7 +1,15 @@
 package anet
 
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// LoadBalance picks the ring a new operator is registered on. addr is the
+// remote address of the connection, nil if there is none.
 type LoadBalance interface {
-	Pick() Ring
+	Pick(addr net.Addr) Ring
 	Rebalance(rings []Ring)
 }
 
@@ -12,19 +20,73 @@ type Ring interface {
 	Alloc() *FDOperator
 	Free(operator *FDOperator)
 	Register(operator *FDOperator)
+	// Unregister removes operator from the ring without releasing it, so that
+	// it can be registered on another ring.
+	Unregister(operator *FDOperator)
+	// Load reports the number of operators registered on the ring.
+	Load() int
+	ProvidedBuffers() bool
+	RecycleBuffer(bid int)
+	Stats() RingStats
 	Close() error
 }
 
+// RingStats is a snapshot of the counters of a ring.
+type RingStats struct {
+	Id string
+	// requests put into the submission queue, linked timeouts included, and
+	// completions handed to the operators
+	Submitted uint64
+	Completed uint64
+	// submissions made, each one carries a batch of requests
+	Batches uint64
+	// requests that ran into EAGAIN and had to be tried again
+	Retries uint64
+	// requests submitted whose final completion is still outstanding
+	Pending int64
+	// operators registered on the ring
+	Operators int
+}
+
 type RingEvent int
 
 const (
-	RingPrepRead  RingEvent = 0x1
-	RingPrepWrite RingEvent = 0x2
+	RingPrepRead    RingEvent = 0x1
+	RingPrepWrite   RingEvent = 0x2
+	RingPrepConnect RingEvent = 0x3
+	RingPrepAccept  RingEvent = 0x4
+	RingPrepRecvMsg RingEvent = 0x5
+	RingPrepSendMsg RingEvent = 0x6
+	RingPrepRecv    RingEvent = 0x7
+	// zero copy sends are picked by the ring itself for writes above the
+	// threshold set with WithZeroCopySend
+	RingPrepSendZC    RingEvent = 0x8
+	RingPrepSendMsgZC RingEvent = 0x9
+	RingPrepSplice    RingEvent = 0xa
+	// completions of timeouts linked to another request, see
+	// RingEventData.Timeout
+	RingPrepLinkTimeout RingEvent = 0xb
+	RingPrepCancel      RingEvent = 0xc
+	// a no-op that wakes the ring up to close it
+	RingPrepNop RingEvent = 0xd
 )
 
 type RingEventData struct {
-	Size     int
-	Data     []byte
-	Event    RingEvent
+	Size      int
+	Data      []byte
+	Event     RingEvent
+	Multishot bool
+	// Timeout links a timeout to the request, which is then cancelled by the
+	// kernel and completes with ECANCELED once it expires
+	Timeout  time.Duration
+	Msg      *syscall.Msghdr
 	Operator *FDOperator
+	// a splice moves Size bytes from SpliceIn at SpliceOffset, which is -1
+	// for pipes, to SpliceOut
+	SpliceIn     int
+	SpliceOut    int
+	SpliceOffset int64
+	// CancelEvent limits a cancel to the requests of that event, it cancels
+	// every request on the fd otherwise
+	CancelEvent RingEvent
 }
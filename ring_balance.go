@@ -0,0 +1,168 @@
+package anet
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// NewRoundRobinLB hands out the rings in turn, which is the default.
+func NewRoundRobinLB() LoadBalance {
+	return &roundRobinLB{}
+}
+
+// NewLeastActiveLB picks the ring with the fewest registered operators, so
+// rings stay even when connection lifetimes vary a lot.
+func NewLeastActiveLB() LoadBalance {
+	return &leastActiveLB{}
+}
+
+// NewAddrHashLB picks the ring by hashing the remote IP address, so that the
+// connections of one client end up on the same ring. Operators without a
+// remote address are handed out in turn.
+func NewAddrHashLB() LoadBalance {
+	return &addrHashLB{}
+}
+
+// NewWeightedLB hands out the rings in turn in proportion to their weights,
+// weights[i] belonging to the i-th ring. Rings without a weight count as
+// weight 1 and rings with a weight of 0 or less are skipped.
+func NewWeightedLB(weights ...int) LoadBalance {
+	return &weightedLB{weights: weights}
+}
+
+// ringSet holds the rings of a balancer, Rebalance may swap them while Pick
+// is running since the manager can be resized at any time.
+type ringSet struct {
+	rings atomic.Pointer[[]Ring]
+}
+
+func (s *ringSet) load() []Ring {
+	rings := s.rings.Load()
+	if rings == nil {
+		return nil
+	}
+	return *rings
+}
+
+func (s *ringSet) Rebalance(rings []Ring) {
+	s.rings.Store(&rings)
+}
+
+type roundRobinLB struct {
+	ringSet
+	lastpicked uint32
+}
+
+func (b *roundRobinLB) Pick(addr net.Addr) (ring Ring) {
+	rings := b.load()
+	if len(rings) == 0 {
+		return nil
+	}
+	index := int(atomic.AddUint32(&b.lastpicked, 1) % uint32(len(rings)))
+	return rings[index]
+}
+
+type leastActiveLB struct {
+	ringSet
+	lastpicked uint32
+}
+
+func (b *leastActiveLB) Pick(addr net.Addr) Ring {
+	rings := b.load()
+	n := len(rings)
+	if n == 0 {
+		return nil
+	}
+	// the scan starts at a different ring every time so that ties are spread
+	start := int(atomic.AddUint32(&b.lastpicked, 1) % uint32(n))
+	best := rings[start]
+	load := best.Load()
+	for i := 1; i < n; i++ {
+		ring := rings[(start+i)%n]
+		if l := ring.Load(); l < load {
+			best, load = ring, l
+		}
+	}
+	return best
+}
+
+type addrHashLB struct {
+	roundRobinLB
+}
+
+func (b *addrHashLB) Pick(addr net.Addr) Ring {
+	rings := b.load()
+	if len(rings) == 0 {
+		return nil
+	}
+	var key []byte
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		key = addr.IP.To16()
+	case *net.UDPAddr:
+		key = addr.IP.To16()
+	case *net.UnixAddr:
+		// peers of unix sockets are mostly unnamed
+		key = []byte(addr.Name)
+	}
+	if len(key) == 0 {
+		return b.roundRobinLB.Pick(addr)
+	}
+	// FNV-1a
+	hash := uint32(2166136261)
+	for _, c := range key {
+		hash ^= uint32(c)
+		hash *= 16777619
+	}
+	return rings[hash%uint32(len(rings))]
+}
+
+// weightedLB is a smooth weighted round robin, which interleaves the rings
+// instead of handing out each one weight times in a row.
+type weightedLB struct {
+	mu      sync.Mutex
+	weights []int
+	rings   []Ring
+	current []int
+}
+
+func (b *weightedLB) Pick(addr net.Addr) Ring {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.rings) == 0 {
+		return nil
+	}
+	total := 0
+	best := -1
+	for i := range b.rings {
+		weight := b.weight(i)
+		if weight <= 0 {
+			continue
+		}
+		b.current[i] += weight
+		total += weight
+		if best < 0 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return b.rings[0]
+	}
+	b.current[best] -= total
+	return b.rings[best]
+}
+
+func (b *weightedLB) Rebalance(rings []Ring) {
+	b.mu.Lock()
+	b.rings = rings
+	b.current = make([]int, len(rings))
+	b.mu.Unlock()
+}
+
+func (b *weightedLB) weight(i int) int {
+	if i < len(b.weights) {
+		return b.weights[i]
+	}
+	return 1
+}
@@ -0,0 +1,74 @@
+package anet
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBalance(t *testing.T) {
+	k := 8
+	// the listener and both ends of every connection pick a ring
+	picks := 2*k + 1
+
+	t.Run("LeastActive", func(t *testing.T) {
+		operators := serveBalanced(t, NewLeastActiveLB(), k)
+		require.Equal(t, picks, sum(operators))
+		require.LessOrEqual(t, slices.Max(operators)-slices.Min(operators), 1)
+	})
+
+	t.Run("AddrHash", func(t *testing.T) {
+		// every connection is between two loopback addresses, only the
+		// listener has no remote address
+		operators := serveBalanced(t, NewAddrHashLB(), k)
+		require.Equal(t, picks, sum(operators))
+		require.GreaterOrEqual(t, slices.Max(operators), 2*k)
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		operators := serveBalanced(t, NewWeightedLB(3, 1, 0), k)
+		require.Equal(t, []int{13, 4, 0}, operators)
+	})
+}
+
+// serveBalanced serves handleEcho from three rings whose operators are handed
+// out by balance, opens k connections one after another and returns the
+// number of operators on each ring.
+func serveBalanced(t *testing.T, balance LoadBalance, k int) []int {
+	m := newTestRingManager(t, WithRingNum(3))
+	m.SetLoadBalance(balance)
+	useRingManager(t, m)
+	_, addr := serveLoop(t, handleEcho)
+
+	operators := func() []int {
+		var operators []int
+		for _, ring := range m.Stats() {
+			operators = append(operators, ring.Operators)
+		}
+		return operators
+	}
+	require.Eventually(t, func() bool {
+		return sum(operators()) == 1
+	}, time.Second, time.Millisecond)
+	for i := 0; i < k; i++ {
+		connection, err := Dial("tcp", addr)
+		require.NoError(t, err)
+		defer connection.Close()
+		echo(t, connection, 1, 48)
+		// the next pick has to see this connection on both ends
+		require.Eventually(t, func() bool {
+			return sum(operators()) == 2*i+3
+		}, time.Second, time.Millisecond)
+	}
+	return operators()
+}
+
+func sum(values []int) int {
+	total := 0
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
@@ -0,0 +1,422 @@
+package anet
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DEFAULT_RING_SIZE  = 1024
+	DEFAULT_BATCH_SIZE = 32
+)
+
+// eagainRetryDelay is how long a request that completed with EAGAIN waits
+// before it is submitted again.
+const eagainRetryDelay = 10 * time.Millisecond
+
+const (
+	sysIOUringSetup    = 425
+	sysIOUringEnter    = 426
+	sysIOUringRegister = 427
+)
+
+// completion flags of io_uring
+const (
+	cqeFBuffer     = 1 << 0
+	cqeFMore       = 1 << 1
+	cqeFNotif      = 1 << 3
+	cqeBufferShift = 16
+)
+
+// ringBackend is the part of a ring that talks to io_uring, everything else
+// is shared through ringCore.
+type ringBackend interface {
+	setup(opts *ringOptions) error
+	prep(eventData RingEventData)
+	submit()
+}
+
+// ringCore keeps the operators of a ring, batches submissions and dispatches
+// completions to the operators.
+type ringCore struct {
+	id      string
+	opmap   sync.Map
+	opcache sync.Pool
+	active  int32
+	ch      chan RingEventData
+	// closed once the submitting goroutine has quit
+	stopped chan struct{}
+	// batches is bumped before every submission and read before completions
+	// are handled, the kernel orders a completion after its submission and
+	// this tells the race detector as well
+	batches uint64
+	sqes    uint64
+	cqes    uint64
+	retries uint64
+	pending int64
+	num     int
+	// entries is the size of the submission queue, batchSize the number of
+	// requests queued at most before they are submitted
+	entries   int
+	batchSize int
+	bufBase   unsafe.Pointer
+	bufNum    int
+	bufSize   int
+	// zero copy sends in flight keyed by user data, and fds whose socket
+	// type does not support them
+	zcThreshold int
+	zcmap       sync.Map
+	zcoff       sync.Map
+}
+
+// zeroCopySend holds a zero copy send until its notification arrives, the
+// buffers stay with the kernel until then.
+type zeroCopySend struct {
+	eventData RingEventData
+	res       int32
+}
+
+// probeIOUring sets up and tears down a minimal ring to find out whether the
+// kernel, or a seccomp profile in front of it, allows io_uring at all.
+func probeIOUring() error {
+	// struct io_uring_params, the kernel fills in the ring offsets
+	var params [120]byte
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, 1, uintptr(unsafe.Pointer(&params[0])), 0)
+	if errno != 0 {
+		return os.NewSyscallError("io_uring_setup", errno)
+	}
+	_ = syscall.Close(int(fd))
+	return nil
+}
+
+func encodeUserData(event RingEvent, fd int) uint64 {
+	if fd > (1 << 56) {
+		panic("encodeUserData panicked: fd will be lost")
+	}
+	return uint64(fd) | (uint64(event) << 56)
+}
+
+func decodeUserData(data uint64) (RingEvent, int) {
+	event := RingEvent(data >> 56)
+	fd := int(data & 0xffffffffffffff)
+	return event, fd
+}
+
+func (r *ringCore) init(opts *ringOptions) {
+	r.id = uuid.New().String()[:8]
+	r.entries = opts.entries
+	r.batchSize = opts.batchSize
+	r.zcThreshold = opts.zeroCopyThreshold
+	r.ch = make(chan RingEventData, opts.batchSize)
+	r.stopped = make(chan struct{})
+	r.opcache = sync.Pool{
+		New: func() interface{} {
+			return &FDOperator{}
+		},
+	}
+	r.num = 0
+}
+
+// start runs the submitting goroutine of backend and waits until it has set
+// up the ring, since with SINGLE_ISSUER only the thread that created the ring
+// may submit to it.
+func (r *ringCore) start(backend ringBackend, opts *ringOptions) error {
+	ready := make(chan error)
+	go r.submitLoop(backend, opts, ready)
+	return <-ready
+}
+
+func (r *ringCore) submitLoop(backend ringBackend, opts *ringOptions, ready chan error) {
+	if opts.cpu >= 0 {
+		err := pinThread(opts.cpu)
+		if err != nil {
+			log.Warnf("[ring %s] failed to pin submission loop to cpu %d: %s", r.id, opts.cpu, err.Error())
+		}
+	} else if opts.flags&setupSingleIssuer != 0 {
+		runtime.LockOSThread()
+	}
+	defer close(r.stopped)
+	err := backend.setup(opts)
+	ready <- err
+	if err != nil {
+		return
+	}
+	for eventData := range r.ch {
+		closing := eventData.Event == RingPrepNop
+		backend.prep(eventData)
+		// requests queued meanwhile go into the same submission
+	batch:
+		for r.num < r.batchSize {
+			select {
+			case eventData := <-r.ch:
+				closing = closing || eventData.Event == RingPrepNop
+				backend.prep(eventData)
+			default:
+				break batch
+			}
+		}
+		atomic.AddUint64(&r.sqes, uint64(r.num))
+		atomic.AddUint64(&r.batches, 1)
+		backend.submit()
+		r.num = 0
+		if closing {
+			return
+		}
+	}
+}
+
+func (r *ringCore) Id() string {
+	return r.id
+}
+
+func (r *ringCore) Submit(eventData RingEventData) {
+	r.trackPending(eventData)
+	r.ch <- eventData
+}
+
+// trackPending counts a request as pending until its final completion, the
+// no-op of Close is not handed to any operator.
+func (r *ringCore) trackPending(eventData RingEventData) {
+	if eventData.Event != RingPrepNop {
+		atomic.AddInt64(&r.pending, 1)
+	}
+}
+
+func (r *ringCore) Alloc() *FDOperator {
+	return r.opcache.Get().(*FDOperator)
+}
+
+func (r *ringCore) Free(operator *FDOperator) {
+	r.Unregister(operator)
+	operator.Reset()
+	r.opcache.Put(operator)
+}
+
+func (r *ringCore) Unregister(operator *FDOperator) {
+	r.delOperator(operator.FD)
+	r.zcoff.Delete(operator.FD)
+}
+
+// Close wakes the ring up with a no-op, the ring is torn down once that has
+// completed. Nothing may be submitted to the ring afterwards.
+func (r *ringCore) Close() error {
+	r.Submit(RingEventData{Event: RingPrepNop})
+	return nil
+}
+
+func (r *ringCore) Register(operator *FDOperator) {
+	_, loaded := r.opmap.Swap(operator.FD, operator)
+	if !loaded {
+		atomic.AddInt32(&r.active, 1)
+	}
+}
+
+func (r *ringCore) Load() int {
+	return int(atomic.LoadInt32(&r.active))
+}
+
+func (r *ringCore) Stats() RingStats {
+	return RingStats{
+		Id:        r.id,
+		Submitted: atomic.LoadUint64(&r.sqes),
+		Completed: atomic.LoadUint64(&r.cqes),
+		Batches:   atomic.LoadUint64(&r.batches),
+		Retries:   atomic.LoadUint64(&r.retries),
+		Pending:   atomic.LoadInt64(&r.pending),
+		Operators: r.Load(),
+	}
+}
+
+func (r *ringCore) operators() []*FDOperator {
+	var operators []*FDOperator
+	r.opmap.Range(func(_, value interface{}) bool {
+		operators = append(operators, value.(*FDOperator))
+		return true
+	})
+	return operators
+}
+
+func (r *ringCore) providedBuffer(bid, n int) []byte {
+	return unsafe.Slice((*byte)(unsafe.Add(r.bufBase, bid*r.bufSize)), n)
+}
+
+func (r *ringCore) zeroCopy(eventData RingEventData) bool {
+	if r.zcThreshold <= 0 || eventData.Size < r.zcThreshold {
+		return false
+	}
+	_, off := r.zcoff.Load(eventData.Operator.FD)
+	return !off
+}
+
+// handleEvent dispatches one completion, the backend has already handed the
+// completion queue entry back to the kernel.
+func (r *ringCore) handleEvent(userData uint64, res int32, flags uint32) {
+	atomic.AddUint64(&r.cqes, 1)
+	event, fd := decodeUserData(userData)
+	if event == RingPrepLinkTimeout || event == RingPrepNop {
+		// the linked request reports the outcome of a timeout, ECANCELED if
+		// it timed out, and a no-op only wakes the ring up
+		return
+	}
+	more := flags&cqeFMore != 0
+	operator := r.getOperator(fd)
+	if operator == nil {
+		if !more {
+			atomic.AddInt64(&r.pending, -1)
+		}
+		log.Warnf("[ring %s] dropped completion of RingEvent %d for unregistered fd %d", r.id, event, fd)
+		return
+	}
+	if res == -int32(syscall.ECANCELED) && event != RingPrepCancel && event != RingPrepSendZC && event != RingPrepSendMsgZC && operator.requeue(event) {
+		atomic.AddInt64(&r.pending, -1)
+		operator.Done()
+		return
+	}
+	switch event {
+	case RingPrepRead, RingPrepRecvMsg:
+		if res < 0 {
+			errno := syscall.Errno(-res)
+			if errno == syscall.EAGAIN {
+				r.retry(operator, event)
+			} else {
+				operator.OnRead(int(res), errno)
+			}
+		} else {
+			operator.OnRead(int(res), nil)
+		}
+	case RingPrepWrite, RingPrepSendMsg:
+		if res < 0 {
+			errno := syscall.Errno(-res)
+			if errno == syscall.EAGAIN {
+				r.retry(operator, event)
+			} else {
+				operator.OnWrite(int(res), errno)
+			}
+		} else {
+			operator.OnWrite(int(res), nil)
+		}
+	case RingPrepConnect:
+		if res < 0 {
+			operator.OnConnect(syscall.Errno(-res))
+		} else {
+			operator.OnConnect(nil)
+		}
+	case RingPrepAccept:
+		if res < 0 {
+			operator.OnAccept(-1, more, syscall.Errno(-res))
+		} else {
+			operator.OnAccept(int(res), more, nil)
+		}
+	case RingPrepSplice:
+		if res < 0 {
+			operator.OnSplice(int(res), syscall.Errno(-res))
+		} else {
+			operator.OnSplice(int(res), nil)
+		}
+	case RingPrepSendZC, RingPrepSendMsgZC:
+		if !r.handleZeroCopy(userData, operator, res, flags) {
+			return
+		}
+	case RingPrepRecv:
+		bid := -1
+		if flags&cqeFBuffer != 0 {
+			bid = int(flags >> cqeBufferShift)
+		}
+		if res < 0 {
+			operator.OnReadBuffer(nil, bid, more, syscall.Errno(-res))
+		} else if bid < 0 {
+			operator.OnReadBuffer(nil, bid, more, nil)
+		} else {
+			operator.OnReadBuffer(r.providedBuffer(bid, int(res)), bid, more, nil)
+		}
+	case RingPrepCancel:
+	default:
+		log.Warnf("[ring %s] unsupported RingEvent", r.id)
+		return
+	}
+	if more && (event == RingPrepAccept || event == RingPrepRecv) {
+		// a multishot request stays in flight until its final completion
+		return
+	}
+	atomic.AddInt64(&r.pending, -1)
+	operator.Done()
+}
+
+// retry submits the request of operator that completed with EAGAIN again
+// after eagainRetryDelay, which happens if its fd is non-blocking. The
+// completion goroutine must not sleep meanwhile.
+func (r *ringCore) retry(operator *FDOperator, event RingEvent) {
+	atomic.AddUint64(&r.retries, 1)
+	eventData := operator.requests[requestSide(event)]
+	// the count keeps the operator from draining before the request is
+	// submitted again
+	atomic.AddInt32(&operator.inflight, 1)
+	time.AfterFunc(eagainRetryDelay, func() {
+		operator.Submit(eventData)
+		operator.Done()
+	})
+}
+
+// handleZeroCopy reports a zero copy send once both of its completions are in,
+// the first one carries the result and the notification tells that the kernel
+// no longer references the buffers. It returns whether the send is finished.
+func (r *ringCore) handleZeroCopy(userData uint64, operator *FDOperator, res int32, flags uint32) bool {
+	value, ok := r.zcmap.Load(userData)
+	if !ok {
+		return false
+	}
+	send := value.(*zeroCopySend)
+	if flags&cqeFNotif == 0 {
+		send.res = res
+		if flags&cqeFMore != 0 {
+			return false
+		}
+	}
+	r.zcmap.Delete(userData)
+	if send.res >= 0 {
+		operator.OnWrite(int(send.res), nil)
+		return true
+	}
+	errno := syscall.Errno(-send.res)
+	if errno == syscall.ECANCELED && operator.requeue(send.eventData.Event) {
+		return true
+	}
+	if errno == syscall.EOPNOTSUPP {
+		// unix sockets among others have no zero copy support, so this fd
+		// falls back to copying sends, which takes over the same request and
+		// so is not counted as pending again. The submit loop may be blocked
+		// on a full completion queue, which only this goroutine empties.
+		r.zcoff.Store(send.eventData.Operator.FD, true)
+		go func() {
+			select {
+			case r.ch <- send.eventData:
+			case <-r.stopped:
+			}
+		}()
+		return false
+	}
+	operator.OnWrite(int(send.res), errno)
+	return true
+}
+
+func (r *ringCore) getOperator(fd int) *FDOperator {
+	operator, ok := r.opmap.Load(fd)
+	if !ok {
+		return nil
+	}
+	return operator.(*FDOperator)
+}
+
+func (r *ringCore) delOperator(fd int) {
+	_, loaded := r.opmap.LoadAndDelete(fd)
+	if loaded {
+		atomic.AddInt32(&r.active, -1)
+	}
+}
@@ -0,0 +1,471 @@
+package anet
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingRetriesEAGAIN(t *testing.T) {
+	m := newTestRingManager(t, WithRingNum(1))
+	ring := m.Pick(nil).(*defaultRing)
+	defer ring.Close()
+
+	fds := make([]int, 2)
+	require.NoError(t, syscall.Pipe2(fds, syscall.O_CLOEXEC))
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	_, err := syscall.Write(fds[1], []byte("ping"))
+	require.NoError(t, err)
+	type result struct {
+		n   int
+		err error
+	}
+	results := make(chan result, 1)
+	op := ring.Alloc()
+	op.FD = fds[0]
+	op.OnRead = func(n int, err error) {
+		results <- result{n, err}
+	}
+	op.Ring = ring
+	op.Register()
+
+	// the kernel only fails a read with EAGAIN in corner cases, so the
+	// completion is made up here as if it had come from the ring
+	buf := make([]byte, 16)
+	op.requests[requestSide(RingPrepRead)] = RingEventData{Event: RingPrepRead, Data: buf, Size: len(buf), Operator: op}
+	atomic.AddInt32(&op.inflight, 1)
+	atomic.AddInt64(&ring.pending, 1)
+	ring.handleEvent(encodeUserData(RingPrepRead, op.FD), -int32(syscall.EAGAIN), 0)
+	require.Equal(t, uint64(1), ring.Stats().Retries)
+
+	// the read is submitted again after a delay instead of being dropped
+	select {
+	case res := <-results:
+		t.Fatalf("read completed before it was retried: %d, %v", res.n, res.err)
+	default:
+	}
+	select {
+	case res := <-results:
+		require.NoError(t, res.err)
+		require.Equal(t, "ping", string(buf[:res.n]))
+	case <-time.After(time.Second):
+		t.Fatalf("read was not retried")
+	}
+
+	freeOperator(op)
+	require.Zero(t, ring.Stats().Pending)
+}
+
+func TestWithProvidedBuffersRoundsUp(t *testing.T) {
+	for _, c := range []struct {
+		num  int
+		want int
+	}{
+		{1, 1},
+		{3, 4},
+		{64, 64},
+		{100, 128},
+		{1 << 20, maxProvidedBufferNum},
+	} {
+		opts := newRingOptions(WithProvidedBuffers(c.num, 64))
+		require.Equal(t, c.want, opts.bufferNum, "num %d", c.num)
+		require.Equal(t, 64, opts.bufferSize)
+	}
+}
+
+func TestRingProvidedBuffers(t *testing.T) {
+	m := newTestRingManager(t, WithProvidedBuffers(3, 64))
+	ring := m.Pick(nil).(*defaultRing)
+	defer ring.Close()
+	require.True(t, ring.ProvidedBuffers())
+	require.Equal(t, 4, ring.bufNum)
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	type result struct {
+		data   string
+		bid    int
+		err    error
+		shared bool
+	}
+	results := make(chan result, 1)
+	op := ring.Alloc()
+	op.FD = fds[0]
+	op.OnReadBuffer = func(data []byte, bid int, more bool, err error) {
+		// the data is read straight into the memory of the ring
+		shared := bid >= 0 && &ring.providedBuffer(bid, 1)[0] == &data[0]
+		results <- result{string(data), bid, err, shared}
+	}
+	op.Ring = ring
+	op.Register()
+	defer freeOperator(op)
+	recv := func(message string) result {
+		_, err := syscall.Write(fds[1], []byte(message))
+		require.NoError(t, err)
+		op.Submit(RingEventData{Event: RingPrepRecv})
+		select {
+		case res := <-results:
+			return res
+		case <-time.After(time.Second):
+			t.Fatalf("receive did not complete")
+			return result{}
+		}
+	}
+
+	// every completion holds on to its buffer until it is recycled
+	bids := map[int]bool{}
+	for i := 0; i < ring.bufNum; i++ {
+		res := recv("ping")
+		require.NoError(t, res.err)
+		require.Equal(t, "ping", res.data)
+		require.True(t, res.shared)
+		require.False(t, bids[res.bid])
+		bids[res.bid] = true
+	}
+	res := recv("pong")
+	require.Equal(t, syscall.ENOBUFS, res.err)
+	require.Equal(t, -1, res.bid)
+
+	// a recycled buffer is picked by the kernel again
+	for bid := range bids {
+		ring.RecycleBuffer(bid)
+	}
+	op.Submit(RingEventData{Event: RingPrepRecv})
+	res = <-results
+	require.NoError(t, res.err)
+	require.Equal(t, "pong", res.data)
+	require.True(t, bids[res.bid])
+	// bids the ring does not know are ignored
+	ring.RecycleBuffer(-1)
+	ring.RecycleBuffer(ring.bufNum)
+}
+
+func TestDialProvidedBuffers(t *testing.T) {
+	m := newTestRingManager(t, WithProvidedBuffers(2, 64))
+	defaultManager := GetRingManager()
+	SetRingManager(m)
+	defer SetRingManager(defaultManager)
+
+	listener := listenEcho(t)
+	conn, err := Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.True(t, conn.(*connection).operator.Ring.ProvidedBuffers())
+
+	// a message larger than the pool takes several buffers, each of which
+	// is copied into the input buffer and handed back to the ring
+	for i := 0; i < 10; i++ {
+		message := GetRandomString(1000)
+		require.NoError(t, conn.Writer().WriteString(message, len(message)))
+		require.NoError(t, conn.Writer().Flush())
+		response, err := conn.Reader().ReadString(len(message))
+		require.NoError(t, err)
+		require.Equal(t, message, response)
+		require.True(t, conn.(*connection).bufferSelect)
+		conn.Reader().Release()
+	}
+}
+
+func TestMultishotBookedReadOutlivesTimeout(t *testing.T) {
+	m := newTestRingManager(t, WithRingNum(1), WithProvidedBuffers(2, 64))
+	defaultManager := GetRingManager()
+	SetRingManager(m)
+	defer SetRingManager(defaultManager)
+	ring := m.Pick(nil).(*defaultRing)
+
+	// another fd holds on to every provided buffer, so the receive of the
+	// connection runs dry at once and falls back to a booked read
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	taken := make(chan int, 1)
+	op := ring.Alloc()
+	op.FD = fds[0]
+	op.OnReadBuffer = func(data []byte, bid int, more bool, err error) {
+		taken <- bid
+	}
+	op.Ring = ring
+	op.Register()
+	defer freeOperator(op)
+	for i := 0; i < ring.bufNum; i++ {
+		_, err := syscall.Write(fds[1], []byte("ping"))
+		require.NoError(t, err)
+		op.Submit(RingEventData{Event: RingPrepRecv})
+		require.GreaterOrEqual(t, <-taken, 0)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	pool := NewSizeClassBufferPool(defaultPoolMinSize, defaultPoolMaxSize, defaultPoolClassIdle)
+	conn, err := Dial("tcp", listener.Addr().String(), WithMultishotRecv(), WithBufferPool(pool), WithReadTimeout(20*time.Millisecond))
+	require.NoError(t, err)
+	defer conn.Close()
+	peer, err := listener.Accept()
+	require.NoError(t, err)
+	defer peer.Close()
+
+	_, err = conn.Reader().ReadBytes(4)
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	c := conn.(*connection)
+	require.Equal(t, int32(1), atomic.LoadInt32(&c.readPending))
+
+	// the kernel still owns the booked block, so releasing the empty input
+	// buffer must not hand it to whoever asks the pool next
+	conn.Reader().Release()
+	other := pool.Get(defaultLinkBlockSize)
+	for i := range other {
+		other[i] = 'x'
+	}
+	_, err = peer.Write([]byte("pong"))
+	require.NoError(t, err)
+	c.readTimeout = time.Second
+	data, err := conn.Reader().ReadBytes(4)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(data))
+	require.Equal(t, strings.Repeat("x", len(other)), string(other))
+}
+
+func TestMultishotBufferExhaustion(t *testing.T) {
+	// a message takes many more buffers than the ring provides, so the
+	// multishot receive keeps running out of them and falls back to reads
+	// into the input buffer
+	m := newTestRingManager(t, WithRingNum(1), WithProvidedBuffers(2, 64))
+	useRingManager(t, m)
+	_, addr := serveLoop(t, handleEcho)
+
+	connection, err := Dial("tcp", addr, WithMultishotRecv())
+	require.NoError(t, err)
+	defer connection.Close()
+
+	// a stalled ring would hang the echo, so it is bounded from here
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		echo(t, connection, 20, 8000)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("echo stalled once the provided buffers ran dry")
+	}
+}
+
+// listenEcho serves a plain net echo server until the test ends.
+func listenEcho(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestRingZeroCopyThreshold(t *testing.T) {
+	m := newTestRingManager(t, WithZeroCopySend(1024))
+	ring := m.Pick(nil).(*defaultRing)
+	defer ring.Close()
+	op := &FDOperator{FD: 100}
+
+	require.False(t, ring.zeroCopy(RingEventData{Size: 1023, Operator: op}))
+	require.True(t, ring.zeroCopy(RingEventData{Size: 1024, Operator: op}))
+	// fds that turned out not to support zero copy keep copying
+	ring.zcoff.Store(op.FD, true)
+	require.False(t, ring.zeroCopy(RingEventData{Size: 1 << 20, Operator: op}))
+	require.True(t, ring.zeroCopy(RingEventData{Size: 1 << 20, Operator: &FDOperator{FD: 101}}))
+
+	m = newTestRingManager(t)
+	plain := m.Pick(nil).(*defaultRing)
+	defer plain.Close()
+	require.False(t, plain.zeroCopy(RingEventData{Size: 1 << 20, Operator: op}))
+}
+
+func TestRingZeroCopySend(t *testing.T) {
+	m := newTestRingManager(t, WithRingNum(1), WithZeroCopySend(1024))
+	ring := m.Pick(nil).(*defaultRing)
+	defer ring.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	peer, err := listener.Accept()
+	require.NoError(t, err)
+	defer peer.Close()
+	file, err := client.(*net.TCPConn).File()
+	require.NoError(t, err)
+	defer file.Close()
+
+	writes := make(chan int, 1)
+	op := ring.Alloc()
+	op.FD = int(file.Fd())
+	op.OnWrite = func(n int, err error) {
+		if err != nil {
+			n = -1
+		}
+		writes <- n
+	}
+	op.Ring = ring
+	op.Register()
+	defer freeOperator(op)
+	send := func(size int) uint64 {
+		completed := ring.Stats().Completed
+		data := []byte(GetRandomString(size))
+		op.Submit(RingEventData{Event: RingPrepWrite, Data: data, Size: size})
+		select {
+		case n := <-writes:
+			require.Equal(t, size, n)
+		case <-time.After(time.Second):
+			t.Fatalf("write of %d bytes did not complete", size)
+		}
+		received := make([]byte, size)
+		_, err := io.ReadFull(peer, received)
+		require.NoError(t, err)
+		require.Equal(t, data, received)
+		return ring.Stats().Completed - completed
+	}
+
+	// a zero copy send completes with its result and then with the
+	// notification that the kernel let go of the buffer, only the latter
+	// reports the write
+	require.Equal(t, uint64(2), send(4096))
+	require.Equal(t, uint64(1), send(512))
+	require.Eventually(t, func() bool {
+		return ring.Stats().Pending == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestRingZeroCopyUnsupported(t *testing.T) {
+	m := newTestRingManager(t, WithRingNum(1), WithZeroCopySend(1024))
+	ring := m.Pick(nil).(*defaultRing)
+	defer ring.Close()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	writes := make(chan int, 1)
+	op := ring.Alloc()
+	op.FD = fds[0]
+	op.OnWrite = func(n int, err error) {
+		if err != nil {
+			n = -1
+		}
+		writes <- n
+	}
+	op.Ring = ring
+	op.Register()
+	defer freeOperator(op)
+
+	// unix sockets have no zero copy support, the send is copied instead
+	data := []byte(GetRandomString(4096))
+	op.Submit(RingEventData{Event: RingPrepWrite, Data: data, Size: len(data)})
+	select {
+	case n := <-writes:
+		require.Equal(t, len(data), n)
+	case <-time.After(time.Second):
+		t.Fatalf("write did not complete")
+	}
+	_, off := ring.zcoff.Load(op.FD)
+	require.True(t, off)
+	received := make([]byte, len(data))
+	n, err := syscall.Read(fds[1], received)
+	require.NoError(t, err)
+	require.Equal(t, data, received[:n])
+	require.Eventually(t, func() bool {
+		return ring.Stats().Pending == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestRingZeroCopyFallbackDoesNotBlock(t *testing.T) {
+	// nothing takes requests off the queue of this ring
+	r := &ringCore{ch: make(chan RingEventData), stopped: make(chan struct{})}
+	op := &FDOperator{FD: 1 << 20}
+	userData := encodeUserData(RingPrepSendZC, op.FD)
+	eventData := RingEventData{Event: RingPrepWrite, Size: 4096, Operator: op}
+	r.zcmap.Store(userData, &zeroCopySend{eventData: eventData})
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- r.handleZeroCopy(userData, op, -int32(syscall.EOPNOTSUPP), 0)
+	}()
+	select {
+	case finished := <-done:
+		require.False(t, finished)
+	case <-time.After(time.Second):
+		t.Fatalf("completion goroutine blocked on the submission queue")
+	}
+	// the copying send is queued once the submit loop gets to it
+	require.Equal(t, eventData, <-r.ch)
+	_, off := r.zcoff.Load(op.FD)
+	require.True(t, off)
+}
+
+func TestRingZeroCopyNotification(t *testing.T) {
+	m := newTestRingManager(t, WithRingNum(1), WithZeroCopySend(1024))
+	ring := m.Pick(nil).(*defaultRing)
+	defer ring.Close()
+
+	fds := make([]int, 2)
+	require.NoError(t, syscall.Pipe2(fds, syscall.O_CLOEXEC))
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	var writes []int
+	op := ring.Alloc()
+	op.FD = fds[1]
+	op.OnWrite = func(n int, err error) {
+		writes = append(writes, n)
+	}
+	op.Ring = ring
+	op.Register()
+	defer freeOperator(op)
+
+	// the completions are made up here so that their order is under control
+	userData := encodeUserData(RingPrepSendZC, op.FD)
+	ring.zcmap.Store(userData, &zeroCopySend{eventData: RingEventData{Event: RingPrepWrite, Size: 4096, Operator: op}})
+	atomic.AddInt32(&op.inflight, 1)
+	atomic.AddInt64(&ring.pending, 1)
+	ring.handleEvent(userData, 4096, cqeFMore)
+	require.Empty(t, writes)
+	require.Equal(t, int64(1), ring.Stats().Pending)
+	ring.handleEvent(userData, 0, cqeFNotif)
+	require.Equal(t, []int{4096}, writes)
+	require.Zero(t, ring.Stats().Pending)
+	_, ok := ring.zcmap.Load(userData)
+	require.False(t, ok)
+
+	// a send that failed reports its error once the notification is in too
+	ring.zcmap.Store(userData, &zeroCopySend{eventData: RingEventData{Event: RingPrepWrite, Size: 4096, Operator: op}})
+	atomic.AddInt32(&op.inflight, 1)
+	atomic.AddInt64(&ring.pending, 1)
+	ring.handleEvent(userData, -int32(syscall.EPIPE), cqeFMore)
+	require.Len(t, writes, 1)
+	ring.handleEvent(userData, 0, cqeFNotif)
+	require.Equal(t, []int{4096, -int(syscall.EPIPE)}, writes)
+	require.Zero(t, ring.Stats().Pending)
+}
@@ -0,0 +1,459 @@
+package anet
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	epollET         = 1 << 31
+	epollEvents     = syscall.EPOLLIN | syscall.EPOLLOUT | syscall.EPOLLRDHUP | epollET
+	spliceFNonblock = 0x2
+)
+
+// epollRing serves the Ring interface with epoll where io_uring is not
+// available. A request is tried right away and otherwise waits until its fd
+// becomes ready, its completion then takes the same path as with io_uring.
+type epollRing struct {
+	ringCore
+	epfd   int
+	wakefd int
+	mu     sync.Mutex
+	queue  []RingEventData
+	spare  []RingEventData
+	fds    map[int]*epollFD
+	// completions are only handed to the operators once mu is released,
+	// since their callbacks submit new requests
+	done []epollCompletion
+	// the earliest deadline among pending requests, zero if there is none
+	deadline time.Time
+	closing  bool
+}
+
+// epollFD holds the requests waiting for an fd to become ready, in the order
+// they were submitted.
+type epollFD struct {
+	armed  bool
+	reads  []*epollOp
+	writes []*epollOp
+}
+
+type epollOp struct {
+	eventData  RingEventData
+	deadline   time.Time
+	connecting bool
+}
+
+type epollCompletion struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+func newEpollRing(opts *ringOptions) (Ring, error) {
+	ring := &epollRing{}
+	ring.init(opts)
+	// zero copy sends and provided buffers need io_uring
+	ring.zcThreshold = 0
+	ring.fds = make(map[int]*epollFD)
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	wakefd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errno != 0 {
+		_ = syscall.Close(epfd)
+		return nil, os.NewSyscallError("eventfd2", errno)
+	}
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(wakefd)}
+	err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, int(wakefd), &event)
+	if err != nil {
+		_ = syscall.Close(epfd)
+		_ = syscall.Close(int(wakefd))
+		return nil, os.NewSyscallError("epoll_ctl", err)
+	}
+	ring.epfd = epfd
+	ring.wakefd = int(wakefd)
+	return ring, nil
+}
+
+func (r *epollRing) Wait() error {
+	events := make([]syscall.EpollEvent, DEFAULT_BATCH_SIZE)
+	for {
+		n, err := syscall.EpollWait(r.epfd, events, r.waitMsec())
+		if err != nil && err != syscall.EINTR {
+			return os.NewSyscallError("epoll_wait", err)
+		}
+		r.mu.Lock()
+		for i := 0; i < n; i++ {
+			r.ready(int(events[i].Fd), events[i].Events)
+		}
+		queue := r.queue
+		r.queue = r.spare
+		if len(queue) > 0 {
+			atomic.AddUint64(&r.sqes, uint64(len(queue)))
+			atomic.AddUint64(&r.batches, 1)
+		}
+		for i := range queue {
+			r.exec(queue[i])
+		}
+		r.expire(time.Now())
+		r.mu.Unlock()
+		clear(queue)
+		r.spare = queue[:0]
+		for _, c := range r.done {
+			r.handleEvent(c.userData, c.res, c.flags)
+		}
+		r.done = r.done[:0]
+		if r.closing {
+			_ = syscall.Close(r.epfd)
+			_ = syscall.Close(r.wakefd)
+			return nil
+		}
+	}
+}
+
+func (r *epollRing) Submit(eventData RingEventData) {
+	r.trackPending(eventData)
+	r.mu.Lock()
+	wake := len(r.queue) == 0
+	r.queue = append(r.queue, eventData)
+	r.mu.Unlock()
+	if wake {
+		one := [8]byte{1}
+		_, _ = syscall.Write(r.wakefd, one[:])
+	}
+}
+
+func (r *epollRing) Register(operator *FDOperator) {
+	// the ring goroutine tries every request itself, so it must never block
+	err := syscall.SetNonblock(operator.FD, true)
+	if err != nil {
+		log.Warnf("[ring %s] failed to set fd %d non-blocking: %s", r.id, operator.FD, err.Error())
+	}
+	r.ringCore.Register(operator)
+}
+
+func (r *epollRing) Free(operator *FDOperator) {
+	r.forget(operator.FD)
+	r.ringCore.Free(operator)
+}
+
+func (r *epollRing) Unregister(operator *FDOperator) {
+	r.forget(operator.FD)
+	r.ringCore.Unregister(operator)
+}
+
+// Close wakes the ring up to tear it down, nothing may be submitted to the
+// ring afterwards.
+func (r *epollRing) Close() error {
+	r.Submit(RingEventData{Event: RingPrepNop})
+	return nil
+}
+
+func (r *epollRing) forget(fd int) {
+	r.mu.Lock()
+	if state, ok := r.fds[fd]; ok {
+		if state.armed {
+			_ = syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+		}
+		delete(r.fds, fd)
+	}
+	r.mu.Unlock()
+}
+
+func (r *epollRing) ProvidedBuffers() bool {
+	return false
+}
+
+func (r *epollRing) RecycleBuffer(bid int) {}
+
+func (r *epollRing) waitMsec() int {
+	if r.deadline.IsZero() {
+		return -1
+	}
+	d := time.Until(r.deadline)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+func (r *epollRing) ready(fd int, events uint32) {
+	if fd == r.wakefd {
+		var buf [8]byte
+		_, _ = syscall.Read(r.wakefd, buf[:])
+		return
+	}
+	state := r.fds[fd]
+	if state == nil {
+		return
+	}
+	if events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+		state.reads = r.process(state.reads)
+	}
+	if events&(syscall.EPOLLOUT|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+		state.writes = r.process(state.writes)
+	}
+}
+
+// process retries the requests waiting on an fd in order until one of them
+// would block again.
+func (r *epollRing) process(ops []*epollOp) []*epollOp {
+	for len(ops) > 0 && r.try(ops[0]) {
+		n := copy(ops, ops[1:])
+		ops[n] = nil
+		ops = ops[:n]
+	}
+	return ops
+}
+
+func (r *epollRing) exec(eventData RingEventData) {
+	if eventData.Event == RingPrepNop {
+		r.closing = true
+		return
+	}
+	fd := eventData.Operator.FD
+	switch eventData.Event {
+	case RingPrepCancel:
+		r.cancel(eventData)
+		return
+	case RingPrepRecv:
+		r.complete(&eventData, -int32(syscall.EINVAL), 0)
+		return
+	}
+	op := &epollOp{eventData: eventData}
+	state := r.fds[fd]
+	// a request may only run once those submitted before it have completed
+	if (state == nil || len(*state.queue(eventData.Event)) == 0) && r.try(op) {
+		return
+	}
+	if state == nil {
+		state = &epollFD{}
+		r.fds[fd] = state
+	}
+	if !state.armed {
+		// edge triggered, so events are reported once per readiness change
+		// and also right away if the fd is ready already
+		event := syscall.EpollEvent{Events: epollEvents, Fd: int32(fd)}
+		err := syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_ADD, fd, &event)
+		if err == syscall.EEXIST {
+			err = syscall.EpollCtl(r.epfd, syscall.EPOLL_CTL_MOD, fd, &event)
+		}
+		if err != nil {
+			r.complete(&op.eventData, errnoResult(err), 0)
+			return
+		}
+		state.armed = true
+	}
+	if eventData.Timeout > 0 {
+		op.deadline = time.Now().Add(eventData.Timeout)
+		r.track(op.deadline)
+	}
+	ops := state.queue(eventData.Event)
+	*ops = append(*ops, op)
+}
+
+func (s *epollFD) queue(event RingEvent) *[]*epollOp {
+	switch event {
+	case RingPrepRead, RingPrepRecvMsg, RingPrepAccept:
+		return &s.reads
+	default:
+		return &s.writes
+	}
+}
+
+// try runs the request and reports whether it completed, it is left pending
+// if it would block.
+func (r *epollRing) try(op *epollOp) bool {
+	eventData := &op.eventData
+	fd := eventData.Operator.FD
+	for {
+		var n int
+		var err error
+		switch eventData.Event {
+		case RingPrepRead:
+			n, err = syscall.Read(fd, eventData.Data[:eventData.Size])
+		case RingPrepWrite:
+			n, err = syscall.Write(fd, eventData.Data[:eventData.Size])
+		case RingPrepRecvMsg:
+			n, err = msgCall(syscall.SYS_RECVMSG, fd, eventData.Msg)
+		case RingPrepSendMsg:
+			n, err = msgCall(syscall.SYS_SENDMSG, fd, eventData.Msg)
+		case RingPrepSplice:
+			n, err = splice(eventData)
+		case RingPrepConnect:
+			if op.connecting {
+				err = connectResult(fd)
+				break
+			}
+			_, _, errno := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&eventData.Data[0])), uintptr(eventData.Size))
+			if errno == syscall.EINPROGRESS {
+				op.connecting = true
+				return false
+			}
+			if errno != 0 {
+				err = errno
+			}
+		case RingPrepAccept:
+			return r.accept(op)
+		default:
+			log.Warnf("[ring %s] unsupported RingEvent", r.id)
+			return true
+		}
+		switch err {
+		case nil:
+			r.complete(eventData, int32(n), 0)
+			return true
+		case syscall.EINTR:
+			continue
+		case syscall.EAGAIN:
+			atomic.AddUint64(&r.retries, 1)
+			return false
+		default:
+			r.complete(eventData, errnoResult(err), 0)
+			return true
+		}
+	}
+}
+
+// accept takes connections off the listener until it would block, a
+// multishot accept stays pending afterwards.
+func (r *epollRing) accept(op *epollOp) bool {
+	eventData := &op.eventData
+	for {
+		fd, _, errno := syscall.Syscall6(syscall.SYS_ACCEPT4, uintptr(eventData.Operator.FD), 0, 0, syscall.SOCK_CLOEXEC, 0, 0)
+		switch {
+		case errno == syscall.EINTR:
+			continue
+		case errno == syscall.EAGAIN:
+			atomic.AddUint64(&r.retries, 1)
+			return false
+		case errno != 0:
+			r.complete(eventData, -int32(errno), 0)
+			return true
+		case !eventData.Multishot:
+			r.complete(eventData, int32(fd), 0)
+			return true
+		}
+		r.complete(eventData, int32(fd), cqeFMore)
+	}
+}
+
+// cancel completes the requests pending on the fd with ECANCELED, like an
+// io_uring cancel of all requests on it or of those of CancelEvent.
+func (r *epollRing) cancel(eventData RingEventData) {
+	n := 0
+	if state := r.fds[eventData.Operator.FD]; state != nil {
+		state.reads = r.cancelOps(state.reads, eventData.CancelEvent, &n)
+		state.writes = r.cancelOps(state.writes, eventData.CancelEvent, &n)
+	}
+	r.complete(&eventData, int32(n), 0)
+}
+
+func (r *epollRing) cancelOps(ops []*epollOp, event RingEvent, n *int) []*epollOp {
+	kept := ops[:0]
+	for _, op := range ops {
+		if event != 0 && op.eventData.Event != event {
+			kept = append(kept, op)
+			continue
+		}
+		r.complete(&op.eventData, -int32(syscall.ECANCELED), 0)
+		*n++
+	}
+	clear(ops[len(kept):])
+	return kept
+}
+
+// expire completes the requests whose timeout has passed with ECANCELED, as
+// a linked timeout would.
+func (r *epollRing) expire(now time.Time) {
+	if r.deadline.IsZero() || now.Before(r.deadline) {
+		return
+	}
+	r.deadline = time.Time{}
+	for _, state := range r.fds {
+		state.reads = r.expireOps(state.reads, now)
+		state.writes = r.expireOps(state.writes, now)
+	}
+}
+
+func (r *epollRing) expireOps(ops []*epollOp, now time.Time) []*epollOp {
+	kept := ops[:0]
+	for _, op := range ops {
+		if !op.deadline.IsZero() {
+			if !now.Before(op.deadline) {
+				r.complete(&op.eventData, -int32(syscall.ECANCELED), 0)
+				continue
+			}
+			r.track(op.deadline)
+		}
+		kept = append(kept, op)
+	}
+	clear(ops[len(kept):])
+	return kept
+}
+
+func (r *epollRing) track(deadline time.Time) {
+	if r.deadline.IsZero() || deadline.Before(r.deadline) {
+		r.deadline = deadline
+	}
+}
+
+func (r *epollRing) complete(eventData *RingEventData, res int32, flags uint32) {
+	userData := encodeUserData(eventData.Event, eventData.Operator.FD)
+	r.done = append(r.done, epollCompletion{userData: userData, res: res, flags: flags})
+}
+
+func errnoResult(err error) int32 {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		errno = syscall.EIO
+	}
+	return -int32(errno)
+}
+
+func msgCall(trap uintptr, fd int, msg *syscall.Msghdr) (int, error) {
+	n, _, errno := syscall.Syscall(trap, uintptr(fd), uintptr(unsafe.Pointer(msg)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func splice(eventData *RingEventData) (int, error) {
+	var off *int64
+	if eventData.SpliceOffset >= 0 {
+		offset := eventData.SpliceOffset
+		off = &offset
+	}
+	n, err := syscall.Splice(eventData.SpliceIn, off, eventData.SpliceOut, nil, eventData.Size, spliceFNonblock)
+	return int(n), err
+}
+
+// connectResult tells how a non-blocking connect turned out, EAGAIN if it is
+// still in progress.
+func connectResult(fd int) error {
+	nerr, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	switch errno := syscall.Errno(nerr); errno {
+	case syscall.EINPROGRESS, syscall.EALREADY, syscall.EINTR:
+		return syscall.EAGAIN
+	case syscall.EISCONN:
+		return nil
+	case 0:
+		_, err := syscall.Getpeername(fd)
+		if err != nil {
+			return syscall.EAGAIN
+		}
+		return nil
+	default:
+		return errno
+	}
+}
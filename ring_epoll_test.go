@@ -0,0 +1,47 @@
+package anet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEpollRing(t *testing.T) {
+	epolls, urings := countFDs(t, "anon_inode:[eventpoll]"), countFDs(t, "anon_inode:[io_uring]")
+	m, err := NewRingManager(WithEpoll(), WithRingNum(2))
+	require.NoError(t, err)
+	// the rings are epoll instances and none of them is an io_uring
+	require.Equal(t, epolls+2, countFDs(t, "anon_inode:[eventpoll]"))
+	require.Equal(t, urings, countFDs(t, "anon_inode:[io_uring]"))
+	useRingManager(t, m)
+
+	_, addr := serveLoop(t, handleEcho)
+	connection, err := Dial("tcp", addr, WithReadTimeout(500*time.Millisecond))
+	require.NoError(t, err)
+	defer connection.Close()
+	// messages larger than the socket buffers leave writes pending on
+	// readiness
+	echo(t, connection, 5, 128*1024)
+
+	// timeouts expire without linked timeout requests
+	_, err = connection.Reader().ReadBytes(1)
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+}
+
+// countFDs returns the number of open fds of the process that link to target.
+func countFDs(t *testing.T, target string) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+	n := 0
+	for _, entry := range entries {
+		link, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name()))
+		if err == nil && link == target {
+			n++
+		}
+	}
+	return n
+}
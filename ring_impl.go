@@ -1,70 +1,91 @@
+//go:build cgo && !anet_purego
+
 package anet
 
 /*
 #cgo LDFLAGS: -luring
+#include <stdlib.h>
 #include <liburing.h>
+
+static inline void anet_prep_recv_select(struct io_uring_sqe *sqe, int fd, unsigned len, unsigned short bgid) {
+	io_uring_prep_recv(sqe, fd, NULL, len, 0);
+	sqe->flags |= IOSQE_BUFFER_SELECT;
+	sqe->buf_group = bgid;
+}
+
+static inline void anet_prep_recv_multishot_select(struct io_uring_sqe *sqe, int fd, unsigned short bgid) {
+	io_uring_prep_recv_multishot(sqe, fd, NULL, 0, 0);
+	sqe->flags |= IOSQE_BUFFER_SELECT;
+	sqe->buf_group = bgid;
+}
+
+static inline void anet_prep_link_timeout(struct io_uring_sqe *sqe, struct io_uring_sqe *tsqe, struct __kernel_timespec *ts) {
+	sqe->flags |= IOSQE_IO_LINK;
+	io_uring_prep_link_timeout(tsqe, ts, 0);
+}
 */
 import "C"
 
 import (
+	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
-
-	"github.com/google/uuid"
 )
 
-const (
-	DEFAULT_RING_SIZE  = 1024
-	DEFAULT_BATCH_SIZE = 32
-)
+// defaultRing drives io_uring through liburing.
+type defaultRing struct {
+	ringCore
+	ring    C.struct_io_uring
+	bufRing *C.struct_io_uring_buf_ring
+	bufMu   sync.Mutex
+	// timespecs of linked timeouts, a slot is only reused after the ring has
+	// wrapped around so the kernel has read it by then
+	timespecs unsafe.Pointer
+	tsn       int
+}
 
-func newDefaultRing() (Ring, error) {
+func newDefaultRing(opts *ringOptions) (Ring, error) {
 	ring := &defaultRing{}
-	C.io_uring_queue_init(DEFAULT_RING_SIZE, &ring.ring, 0)
-	ring.id = uuid.New().String()[:8]
-	ring.ch = make(chan RingEventData, 4)
-	ring.opcache = sync.Pool{
-		New: func() interface{} {
-			return &FDOperator{}
-		},
-	}
-	ring.num = 0
+	ring.init(opts)
+	err := ring.start(ring, opts)
+	if err != nil {
+		return nil, err
+	}
 	return ring, nil
 }
 
-func encodeUserData(event RingEvent, fd int) uint64 {
-	if fd > (1 << 56) {
-		panic("encodeUserData panicked: fd will be lost")
+func (r *defaultRing) setup(opts *ringOptions) error {
+	var params C.struct_io_uring_params
+	params.flags = C.__u32(opts.flags)
+	if opts.cqEntries > 0 {
+		params.flags |= C.IORING_SETUP_CQSIZE
+		params.cq_entries = C.__u32(opts.cqEntries)
 	}
-	return uint64(fd) | (uint64(event) << 56)
-}
-
-func decodeUserData(data uint64) (RingEvent, int) {
-	event := RingEvent(data >> 56)
-	fd := int(data & 0xffffffffffffff)
-	return event, fd
-}
-
-type defaultRing struct {
-	id      string
-	opmap   sync.Map
-	opcache sync.Pool
-	ring    C.struct_io_uring
-	ch      chan RingEventData
-	num     int
-	mu      sync.Mutex
-}
-
-func (r *defaultRing) Id() string {
-	return r.id
+	if opts.flags&setupSQPoll != 0 {
+		params.sq_thread_idle = C.__u32(opts.sqThreadIdle / time.Millisecond)
+		if opts.sqCPU >= 0 {
+			params.flags |= C.IORING_SETUP_SQ_AFF
+			params.sq_thread_cpu = C.__u32(opts.sqCPU)
+		}
+	}
+	ret := C.io_uring_queue_init_params(C.uint(opts.entries), &r.ring, &params)
+	if ret < 0 {
+		return os.NewSyscallError("io_uring_queue_init_params", syscall.Errno(-ret))
+	}
+	r.timespecs = C.malloc(C.size_t(r.entries * C.sizeof_struct___kernel_timespec))
+	if opts.bufferNum > 0 {
+		err := r.setupBufferRing(opts.bufferNum, opts.bufferSize)
+		if err != nil {
+			log.Warnf("[ring %s] provided buffers are disabled: %s", r.id, err.Error())
+		}
+	}
+	return nil
 }
 
 func (r *defaultRing) Wait() error {
-	go r.submitLoop()
-	go r.loop()
-
 	var cqe *C.struct_io_uring_cqe
 	cqes := make([]*C.struct_io_uring_cqe, DEFAULT_BATCH_SIZE)
 	for {
@@ -72,123 +93,196 @@ func (r *defaultRing) Wait() error {
 		if cqe == nil {
 			continue
 		}
-		r.handleEvent(cqe)
+		atomic.LoadUint64(&r.batches)
+		closed := r.reap(cqe)
 		count := C.io_uring_peek_batch_cqe(&r.ring, &cqes[0], DEFAULT_BATCH_SIZE)
 		for i := 0; i < int(count); i++ {
-			r.handleEvent(cqes[i])
+			closed = r.reap(cqes[i]) || closed
+		}
+		if closed {
+			<-r.stopped
+			r.onClose()
+			return nil
 		}
 	}
 }
 
-func (r *defaultRing) Submit(eventData RingEventData) {
-	r.ch <- eventData
+// reap hands one completion to its operator and reports whether it is the
+// no-op submitted by Close.
+func (r *defaultRing) reap(cqe *C.struct_io_uring_cqe) bool {
+	userData, res, flags := uint64(cqe.user_data), int32(cqe.res), uint32(cqe.flags)
+	C.io_uring_cqe_seen(&r.ring, cqe)
+	r.handleEvent(userData, res, flags)
+	event, _ := decodeUserData(userData)
+	return event == RingPrepNop
 }
 
-func (r *defaultRing) Close() error {
-	return nil
+func (r *defaultRing) ProvidedBuffers() bool {
+	return r.bufRing != nil
 }
 
-func (r *defaultRing) Alloc() *FDOperator {
-	return r.opcache.Get().(*FDOperator)
+func (r *defaultRing) RecycleBuffer(bid int) {
+	if r.bufRing == nil || bid < 0 || bid >= r.bufNum {
+		return
+	}
+	r.bufMu.Lock()
+	C.io_uring_buf_ring_add(r.bufRing, unsafe.Add(r.bufBase, bid*r.bufSize), C.uint(r.bufSize), C.ushort(bid), C.io_uring_buf_ring_mask(C.__u32(r.bufNum)), 0)
+	C.io_uring_buf_ring_advance(r.bufRing, 1)
+	r.bufMu.Unlock()
 }
 
-func (r *defaultRing) Free(operator *FDOperator) {
-	r.delOperator(operator.FD)
-	operator.Reset()
-	r.opcache.Put(operator)
+func (r *defaultRing) setupBufferRing(num, size int) error {
+	var ret C.int
+	bufRing := C.io_uring_setup_buf_ring(&r.ring, C.uint(num), providedBufferGroup, 0, &ret)
+	if bufRing == nil {
+		return syscall.Errno(-ret)
+	}
+	// the buffers live outside of the Go heap since the kernel keeps their
+	// addresses for as long as the ring exists
+	r.bufBase = C.malloc(C.size_t(num * size))
+	r.bufRing = bufRing
+	r.bufNum = num
+	r.bufSize = size
+	mask := C.io_uring_buf_ring_mask(C.__u32(num))
+	for bid := 0; bid < num; bid++ {
+		C.io_uring_buf_ring_add(bufRing, unsafe.Add(r.bufBase, bid*size), C.uint(size), C.ushort(bid), mask, C.int(bid))
+	}
+	C.io_uring_buf_ring_advance(bufRing, C.int(num))
+	return nil
 }
 
-func (r *defaultRing) Register(operator *FDOperator) {
-	r.opmap.Store(operator.FD, operator)
+func (r *defaultRing) submit() {
+	C.io_uring_submit(&r.ring)
 }
 
-func (r *defaultRing) submitLoop() {
-	for eventData := range r.ch {
-		r.mu.Lock()
-		sqe := C.io_uring_get_sqe(&r.ring)
-		if sqe == nil {
-			panic("should't failed here")
-		}
-		switch eventData.Event {
-		case RingPrepRead:
-			userData := encodeUserData(RingPrepRead, eventData.Operator.FD)
-			sqe.user_data = C.ulonglong(userData)
-			C.io_uring_prep_read(sqe, C.int(eventData.Operator.FD), unsafe.Pointer(&eventData.Data[0]), C.uint(eventData.Size), 0)
-		case RingPrepWrite:
-			userData := encodeUserData(RingPrepWrite, eventData.Operator.FD)
-			sqe.user_data = C.ulonglong(userData)
-			C.io_uring_prep_write(sqe, C.int(eventData.Operator.FD), unsafe.Pointer(&eventData.Data[0]), C.uint(eventData.Size), 0)
-		default:
-			panic("should't failed here")
-		}
-		r.num += 1
-		if r.num >= 10 {
-			C.io_uring_submit(&r.ring)
-			r.num = 0
+// reserve waits until the submission queue has room for n entries. It fills
+// up when the SQPOLL thread falls behind or a failed submission left its
+// entries queued, those are flushed again meanwhile.
+func (r *defaultRing) reserve(n int) {
+	for int(C.io_uring_sq_space_left(&r.ring)) < n {
+		atomic.AddUint64(&r.batches, 1)
+		ret := C.io_uring_submit(&r.ring)
+		if ret < 0 {
+			log.Warnf("[ring %s] failed to flush full submission queue: %s", r.id, syscall.Errno(-ret).Error())
+			// the completions reaped meanwhile let the next attempt through
+			time.Sleep(time.Millisecond)
+			continue
 		}
-		r.mu.Unlock()
+		C.io_uring_sqring_wait(&r.ring)
 	}
 }
 
-func (r *defaultRing) loop() {
-	for {
-		time.Sleep(time.Microsecond)
-		r.mu.Lock()
-		if r.num > 0 {
-			C.io_uring_submit(&r.ring)
-			r.num = 0
-		}
-		r.mu.Unlock()
+func (r *defaultRing) prep(eventData RingEventData) {
+	// a request with a timeout takes a second entry, which has to follow it
+	// in the same submission
+	if eventData.Timeout > 0 {
+		r.reserve(2)
+	} else {
+		r.reserve(1)
 	}
-}
-
-func (r *defaultRing) handleEvent(cqe *C.struct_io_uring_cqe) {
-	C.io_uring_cqe_seen(&r.ring, cqe)
-	userData := uint64(cqe.user_data)
-	event, fd := decodeUserData(userData)
-	operator := r.getOperator(fd)
-	switch event {
+	sqe := C.io_uring_get_sqe(&r.ring)
+	if sqe == nil {
+		panic("should't failed here")
+	}
+	if eventData.Event == RingPrepNop {
+		C.io_uring_prep_nop(sqe)
+		sqe.user_data = C.ulonglong(encodeUserData(RingPrepNop, 0))
+		r.num += 1
+		return
+	}
+	switch eventData.Event {
 	case RingPrepRead:
-		if cqe.res < 0 {
-			errno := syscall.Errno(-cqe.res)
-			if errno == syscall.EAGAIN {
-				log.Warnf("[ring %s] error occurred while waiting, wait 10ms to retry: %s", r.id, errno.Error())
-				time.Sleep(time.Millisecond * 10)
-			} else {
-				operator.OnRead(int(cqe.res), errno)
-			}
+		userData := encodeUserData(RingPrepRead, eventData.Operator.FD)
+		sqe.user_data = C.ulonglong(userData)
+		C.io_uring_prep_read(sqe, C.int(eventData.Operator.FD), unsafe.Pointer(&eventData.Data[0]), C.uint(eventData.Size), 0)
+	case RingPrepWrite:
+		if r.zeroCopy(eventData) {
+			userData := encodeUserData(RingPrepSendZC, eventData.Operator.FD)
+			r.zcmap.Store(userData, &zeroCopySend{eventData: eventData})
+			sqe.user_data = C.ulonglong(userData)
+			C.io_uring_prep_send_zc(sqe, C.int(eventData.Operator.FD), unsafe.Pointer(&eventData.Data[0]), C.size_t(eventData.Size), 0, 0)
+			break
+		}
+		userData := encodeUserData(RingPrepWrite, eventData.Operator.FD)
+		sqe.user_data = C.ulonglong(userData)
+		C.io_uring_prep_write(sqe, C.int(eventData.Operator.FD), unsafe.Pointer(&eventData.Data[0]), C.uint(eventData.Size), 0)
+	case RingPrepConnect:
+		userData := encodeUserData(RingPrepConnect, eventData.Operator.FD)
+		sqe.user_data = C.ulonglong(userData)
+		C.io_uring_prep_connect(sqe, C.int(eventData.Operator.FD), (*C.struct_sockaddr)(unsafe.Pointer(&eventData.Data[0])), C.socklen_t(eventData.Size))
+	case RingPrepAccept:
+		userData := encodeUserData(RingPrepAccept, eventData.Operator.FD)
+		sqe.user_data = C.ulonglong(userData)
+		if eventData.Multishot {
+			C.io_uring_prep_multishot_accept(sqe, C.int(eventData.Operator.FD), nil, nil, C.SOCK_CLOEXEC)
 		} else {
-			operator.OnRead(int(cqe.res), nil)
+			C.io_uring_prep_accept(sqe, C.int(eventData.Operator.FD), nil, nil, C.SOCK_CLOEXEC)
 		}
-	case RingPrepWrite:
-		if cqe.res < 0 {
-			errno := syscall.Errno(-cqe.res)
-			if errno == syscall.EAGAIN {
-				log.Warnf("[ring %s] error occurred while waiting, wait 10ms to retry: %s", r.id, errno.Error())
-				time.Sleep(time.Millisecond * 10)
-			} else {
-				operator.OnWrite(int(cqe.res), errno)
-			}
+	case RingPrepRecvMsg:
+		userData := encodeUserData(RingPrepRecvMsg, eventData.Operator.FD)
+		sqe.user_data = C.ulonglong(userData)
+		C.io_uring_prep_recvmsg(sqe, C.int(eventData.Operator.FD), (*C.struct_msghdr)(unsafe.Pointer(eventData.Msg)), 0)
+	case RingPrepSendMsg:
+		if r.zeroCopy(eventData) {
+			userData := encodeUserData(RingPrepSendMsgZC, eventData.Operator.FD)
+			r.zcmap.Store(userData, &zeroCopySend{eventData: eventData})
+			sqe.user_data = C.ulonglong(userData)
+			C.io_uring_prep_sendmsg_zc(sqe, C.int(eventData.Operator.FD), (*C.struct_msghdr)(unsafe.Pointer(eventData.Msg)), 0)
+			break
+		}
+		userData := encodeUserData(RingPrepSendMsg, eventData.Operator.FD)
+		sqe.user_data = C.ulonglong(userData)
+		C.io_uring_prep_sendmsg(sqe, C.int(eventData.Operator.FD), (*C.struct_msghdr)(unsafe.Pointer(eventData.Msg)), 0)
+	case RingPrepSplice:
+		userData := encodeUserData(RingPrepSplice, eventData.Operator.FD)
+		sqe.user_data = C.ulonglong(userData)
+		C.io_uring_prep_splice(sqe, C.int(eventData.SpliceIn), C.int64_t(eventData.SpliceOffset), C.int(eventData.SpliceOut), -1, C.uint(eventData.Size), 0)
+	case RingPrepCancel:
+		userData := encodeUserData(RingPrepCancel, eventData.Operator.FD)
+		sqe.user_data = C.ulonglong(userData)
+		if eventData.CancelEvent != 0 {
+			target := encodeUserData(eventData.CancelEvent, eventData.Operator.FD)
+			C.io_uring_prep_cancel64(sqe, C.__u64(target), C.IORING_ASYNC_CANCEL_ALL)
+		} else {
+			C.io_uring_prep_cancel_fd(sqe, C.int(eventData.Operator.FD), C.IORING_ASYNC_CANCEL_ALL)
+		}
+	case RingPrepRecv:
+		userData := encodeUserData(RingPrepRecv, eventData.Operator.FD)
+		if eventData.Multishot {
+			C.anet_prep_recv_multishot_select(sqe, C.int(eventData.Operator.FD), providedBufferGroup)
 		} else {
-			operator.OnWrite(int(cqe.res), nil)
+			C.anet_prep_recv_select(sqe, C.int(eventData.Operator.FD), C.uint(r.bufSize), providedBufferGroup)
 		}
+		sqe.user_data = C.ulonglong(userData)
 	default:
-		log.Warnf("[ring %s] unsupported RingEvent", r.id)
+		panic("should't failed here")
 	}
-}
-
-func (r *defaultRing) getOperator(fd int) *FDOperator {
-	operator, ok := r.opmap.Load(fd)
-	if !ok {
-		return nil
+	if eventData.Timeout > 0 {
+		r.prepLinkTimeout(sqe, eventData)
 	}
-	return operator.(*FDOperator)
+	r.num += 1
 }
 
-func (r *defaultRing) delOperator(fd int) {
-	r.opmap.Delete(fd)
+func (r *defaultRing) prepLinkTimeout(sqe *C.struct_io_uring_sqe, eventData RingEventData) {
+	tsqe := C.io_uring_get_sqe(&r.ring)
+	if tsqe == nil {
+		panic("should't failed here")
+	}
+	ts := (*C.struct___kernel_timespec)(unsafe.Add(r.timespecs, r.tsn*C.sizeof_struct___kernel_timespec))
+	r.tsn = (r.tsn + 1) % r.entries
+	ts.tv_sec = C.longlong(eventData.Timeout / time.Second)
+	ts.tv_nsec = C.longlong(eventData.Timeout % time.Second)
+	C.anet_prep_link_timeout(sqe, tsqe, ts)
+	tsqe.user_data = C.ulonglong(encodeUserData(RingPrepLinkTimeout, eventData.Operator.FD))
+	r.num += 1
 }
 
 func (r *defaultRing) onClose() {
+	if r.bufRing != nil {
+		C.io_uring_free_buf_ring(&r.ring, r.bufRing, C.uint(r.bufNum), providedBufferGroup)
+		C.free(r.bufBase)
+		r.bufRing = nil
+	}
 	C.io_uring_queue_exit(&r.ring)
+	C.free(r.timespecs)
 }
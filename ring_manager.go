@@ -2,67 +2,229 @@ package anet
 
 import (
 	"errors"
+	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
-func newDefaultRingManager(n int) *manager {
-	ringmanager := &manager{}
-	ringmanager.numLoops = n
-	ringmanager.balance = &roundRobinLB{}
+// retireInterval is how often a removed ring looks for operators that still
+// have to migrate.
+const retireInterval = 10 * time.Millisecond
+
+// newDefaultRingManager sets up the ring manager used unless another one is
+// set. It is called while the package is initialized, so rather than failing
+// it serves every ring with epoll if io_uring could not set them up.
+func newDefaultRingManager(ops ...RingOption) *Manager {
+	ringmanager := &Manager{}
+	ringmanager.opts = newRingOptions(ops...)
+	ringmanager.numLoops = ringmanager.opts.ringNum
+	ringmanager.SetLoadBalance(NewRoundRobinLB())
 	err := ringmanager.Run()
+	if err != nil && !ringmanager.opts.epoll {
+		log.Warnf("failed to set up rings, falling back to epoll: %s", err.Error())
+		for _, ring := range ringmanager.rings {
+			_ = ring.Close()
+		}
+		ringmanager.opts.epoll = true
+		err = ringmanager.Run()
+	}
 	if err != nil {
-		panic("should't failed here")
+		log.Warnf("failed to set up rings: %s", err.Error())
 	}
 	return ringmanager
 }
 
-type roundRobinLB struct {
-	rings      []Ring
-	lastpicked int32
+// NewRingManager sets up the rings described by ops, an error is returned if
+// any of them could not be set up. Pass the result to SetRingManager before
+// creating connections to put it to use.
+func NewRingManager(ops ...RingOption) (*Manager, error) {
+	ringmanager := &Manager{}
+	ringmanager.opts = newRingOptions(ops...)
+	ringmanager.numLoops = ringmanager.opts.ringNum
+	ringmanager.SetLoadBalance(NewRoundRobinLB())
+	err := ringmanager.Run()
+	if err != nil {
+		return nil, err
+	}
+	return ringmanager, nil
 }
 
-func (b *roundRobinLB) Pick() (ring Ring) {
-	if len(b.rings) == 0 {
-		return nil
+var ringManager atomic.Pointer[Manager]
+
+// RingManager is the ring manager set up when the package is initialized, it
+// is not changed by SetRingManager.
+//
+// Deprecated: use GetRingManager and SetRingManager. A manager assigned to
+// RingManager before connections are created is still used for them, ahead of
+// the one set with SetRingManager.
+var RingManager *Manager
+
+// defaultRingManager is what RingManager was initialized with.
+var defaultRingManager *Manager
+
+// GetRingManager returns the ring manager new connections are registered
+// with.
+func GetRingManager() *Manager {
+	if m := RingManager; m != defaultRingManager {
+		return m
 	}
-	index := int(atomic.AddInt32(&b.lastpicked, 1)) % len(b.rings)
-	return b.rings[index]
+	return ringManager.Load()
 }
 
-func (b *roundRobinLB) Rebalance(rings []Ring) {
-	b.rings = rings
-	b.lastpicked = 0
+// SetRingManager replaces the ring manager new connections are registered
+// with, it may be called while connections are being set up. Connections
+// already registered stay on their rings.
+func SetRingManager(m *Manager) {
+	ringManager.Store(m)
 }
 
-var RingManager *manager
-
-type manager struct {
+// Manager spreads the operators of new connections over its rings and resizes
+// the set of rings on demand.
+type Manager struct {
+	mu       sync.Mutex
 	numLoops int
+	opts     *ringOptions
 	rings    []Ring
-	balance  LoadBalance
+	balance  atomic.Pointer[LoadBalance]
+	newRing  func(opts *ringOptions) (Ring, error)
+	// CPUs the rings are pinned to in turn, none if they are not pinned
+	cpus []int
+}
+
+// Pick returns the ring a new operator is registered on, addr is the remote
+// address of the connection if there is one.
+func (m *Manager) Pick(addr net.Addr) Ring {
+	return (*m.balance.Load()).Pick(addr)
+}
+
+// SetLoadBalance replaces the strategy that picks rings, round robin by
+// default.
+func (m *Manager) SetLoadBalance(balance LoadBalance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	balance.Rebalance(m.rings)
+	m.balance.Store(&balance)
+}
+
+// Stats returns a snapshot of the counters of every ring in use, rings that
+// are being retired are left out.
+func (m *Manager) Stats() []RingStats {
+	m.mu.Lock()
+	rings := m.rings
+	m.mu.Unlock()
+	stats := make([]RingStats, 0, len(rings))
+	for _, ring := range rings {
+		stats = append(stats, ring.Stats())
+	}
+	return stats
+}
+
+func (m *Manager) Run() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.newRing = newDefaultRing
+	if m.opts.epoll {
+		m.newRing = newEpollRing
+	} else if err := probeIOUring(); err != nil {
+		log.Warnf("io_uring is unavailable, falling back to epoll: %s", err.Error())
+		m.newRing = newEpollRing
+	}
+	m.cpus = m.opts.cpus
+	if m.opts.autoAffinity {
+		cpus, err := availableCPUs()
+		if err != nil {
+			log.Warnf("failed to list cpus, rings are not pinned: %s", err.Error())
+		}
+		m.cpus = cpus
+	}
+	rings, err := m.openRings(m.numLoops)
+	m.rings = rings
+	(*m.balance.Load()).Rebalance(m.rings)
+	return err
 }
 
-func (m *manager) Pick() Ring {
-	return m.balance.Pick()
+// Resize grows or shrinks the manager to n rings. Removed rings take no new
+// operators, the ones registered on them migrate to the remaining rings once
+// their requests in flight have completed and the rings are closed as soon
+// as they are empty.
+func (m *Manager) Resize(n int) error {
+	if n < 1 {
+		return errors.New("a ring manager needs at least one ring")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n > len(m.rings) {
+		rings, err := m.openRings(n - len(m.rings))
+		m.rings = append(m.rings[:len(m.rings):len(m.rings)], rings...)
+		m.numLoops = len(m.rings)
+		(*m.balance.Load()).Rebalance(m.rings)
+		return err
+	}
+	retired := m.rings[n:]
+	m.rings = m.rings[:n:n]
+	m.numLoops = n
+	(*m.balance.Load()).Rebalance(m.rings)
+	for _, ring := range retired {
+		go m.retire(ring)
+	}
+	return nil
 }
 
-func (m *manager) Run() error {
+func (m *Manager) openRings(n int) ([]Ring, error) {
 	var errs []error
 	var rings []Ring
-	for index := 0; index < m.numLoops; index++ {
-		ring, err := newDefaultRing()
+	for index := 0; index < n; index++ {
+		opts := m.ringOptions(len(m.rings) + len(rings))
+		ring, err := m.newRing(opts)
 		if err != nil {
 			errs = append(errs, err)
-			log.Warnf("error occurred while open ring")
+			log.Warnf("error occurred while open ring: %s", err.Error())
 		} else {
 			go func() {
-				_ = ring.Wait()
+				if opts.cpu >= 0 {
+					err := pinThread(opts.cpu)
+					if err != nil {
+						log.Warnf("[ring %s] failed to pin completion loop to cpu %d: %s", ring.Id(), opts.cpu, err.Error())
+					}
+				}
+				err := ring.Wait()
+				if err != nil {
+					log.Warnf("[ring %s] ring quit with error: %s", ring.Id(), err.Error())
+				}
 			}()
 			rings = append(rings, ring)
 		}
 	}
-	m.rings = rings
-	m.balance.Rebalance(m.rings)
-	err := errors.Join(errs...)
-	return err
+	return rings, errors.Join(errs...)
+}
+
+// ringOptions returns the options of the ring at position i, which only
+// differ from the others in the CPUs the ring is pinned to.
+func (m *Manager) ringOptions(i int) *ringOptions {
+	opts := *m.opts
+	if len(m.cpus) > 0 {
+		opts.cpu = m.cpus[i%len(m.cpus)]
+	}
+	opts.sqCPU = opts.cpu
+	if len(opts.sqCPUs) > 0 {
+		opts.sqCPU = opts.sqCPUs[i%len(opts.sqCPUs)]
+	}
+	return &opts
+}
+
+// retire migrates the operators of a removed ring until none are left and
+// closes it then. Operators registered after the ring has been removed were
+// picked just before, so they are looked for again every round.
+func (m *Manager) retire(ring Ring) {
+	for ring.Load() > 0 {
+		if r, ok := ring.(interface{ operators() []*FDOperator }); ok {
+			for _, operator := range r.operators() {
+				operator.Migrate(m.Pick(nil))
+			}
+		}
+		time.Sleep(retireInterval)
+	}
+	log.Infof("[ring %s] ring retired", ring.Id())
+	_ = ring.Close()
 }
@@ -0,0 +1,186 @@
+package anet
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDefaultRingManagerFallback(t *testing.T) {
+	// the kernel rejects unknown setup flags, so io_uring sets up no ring
+	m := newDefaultRingManager(WithRingNum(2), WithSetupFlags(1<<31))
+	defer func() {
+		for _, ring := range m.rings {
+			_ = ring.Close()
+		}
+	}()
+	require.Len(t, m.rings, 2)
+	for _, ring := range m.rings {
+		require.IsType(t, &epollRing{}, ring)
+	}
+
+	skipWithoutIOUring(t, probeIOUring())
+	_, err := NewRingManager(WithRingNum(2), WithSetupFlags(1<<31))
+	require.Error(t, err)
+}
+
+// newTestRingManager sets up the rings of a test with io_uring, the test is
+// skipped if the kernel or a seccomp profile in front of it does not allow
+// that.
+func newTestRingManager(t *testing.T, ops ...RingOption) *Manager {
+	t.Helper()
+	skipWithoutIOUring(t, probeIOUring())
+	m, err := NewRingManager(ops...)
+	skipWithoutIOUring(t, err)
+	require.NoError(t, err)
+	return m
+}
+
+// useRingManager registers the connections of the rest of the test with m.
+func useRingManager(t *testing.T, m *Manager) {
+	defaultManager := GetRingManager()
+	SetRingManager(m)
+	t.Cleanup(func() {
+		SetRingManager(defaultManager)
+	})
+}
+
+// skipWithoutIOUring skips the test if err tells that io_uring, or a feature
+// of it such as SQPOLL, is not implemented or not permitted.
+func skipWithoutIOUring(t *testing.T, err error) {
+	t.Helper()
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+		t.Skipf("io_uring is unavailable: %s", err)
+	}
+}
+
+func TestDeprecatedRingManager(t *testing.T) {
+	m := newTestRingManager(t, WithRingNum(1))
+	defaultManager := GetRingManager()
+	require.Same(t, RingManager, defaultManager)
+
+	// a manager set the new way leaves the variable alone
+	SetRingManager(m)
+	require.Same(t, m, GetRingManager())
+	require.Same(t, defaultManager, RingManager)
+	SetRingManager(defaultManager)
+
+	// and one assigned the old way is still picked up
+	RingManager = m
+	require.Same(t, m, GetRingManager())
+	RingManager = defaultManager
+	require.Same(t, defaultManager, GetRingManager())
+}
+
+func TestRingFullSubmissionQueue(t *testing.T) {
+	// the polling thread consumes the two entries of the submission queue
+	// behind the back of the ring, which has to wait for them to free up
+	m := newTestRingManager(t, WithRingNum(1), WithRingEntries(2), WithSQPoll(time.Millisecond))
+	defaultManager := GetRingManager()
+	SetRingManager(m)
+	defer SetRingManager(defaultManager)
+
+	listener := listenEcho(t)
+	c := 16
+	errs := make(chan error, c)
+	var wg sync.WaitGroup
+	for i := 0; i < c; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- echoLines(listener.Addr().String(), 100)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestRingManagerResize(t *testing.T) {
+	m := newTestRingManager(t, WithRingNum(4), WithProvidedBuffers(64, 4096))
+	useRingManager(t, m)
+	_, addr := serveLoop(t, handleEcho)
+
+	// the dialed ends of half of the connections keep a multishot receive
+	// armed, the served ends wait with a single shot read
+	n := 8
+	var connections []Connection
+	for i := 0; i < n; i++ {
+		var ops []Option
+		if i%2 == 0 {
+			ops = append(ops, WithMultishotRecv())
+		}
+		connection, err := Dial("tcp", addr, ops...)
+		require.NoError(t, err)
+		defer connection.Close()
+		echo(t, connection, 1, 48)
+		connections = append(connections, connection)
+	}
+
+	operators := func() int {
+		total := 0
+		for _, ring := range m.Stats() {
+			total += ring.Operators
+		}
+		return total
+	}
+	// the listener and both ends of every connection
+	total := 2*n + 1
+	require.Eventually(t, func() bool {
+		return operators() == total
+	}, time.Second, time.Millisecond)
+	urings := countFDs(t, "anon_inode:[io_uring]")
+
+	rings := 4
+	for _, size := range []int{1, 3, 2, 1} {
+		require.NoError(t, m.Resize(size))
+		urings += size - rings
+		rings = size
+		// every connection is idle, so the removed rings are only closed
+		// once their pending requests have moved on
+		require.Eventually(t, func() bool {
+			return countFDs(t, "anon_inode:[io_uring]") == urings
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Len(t, m.Stats(), size)
+		require.Equal(t, total, operators())
+		for _, connection := range connections {
+			echo(t, connection, 1, 48)
+		}
+	}
+}
+
+// echoLines dials addr, whose server echoes everything back, and sends it m
+// lines, every read of the connection has a linked timeout.
+func echoLines(addr string, m int) error {
+	connection, err := Dial("tcp", addr, WithReadTimeout(5*time.Second))
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	reader, writer := connection.Reader(), connection.Writer()
+	for i := 0; i < m; i++ {
+		message := GetRandomString(47) + "\n"
+		err = writer.WriteString(message, len(message))
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		response, err := reader.ReadUtil('\n')
+		if err != nil {
+			return err
+		}
+		if string(response) != message {
+			return errors.New("unexpected response")
+		}
+		reader.Release()
+	}
+	return nil
+}
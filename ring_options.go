@@ -0,0 +1,212 @@
+package anet
+
+import "time"
+
+const (
+	providedBufferGroup    = 0
+	maxProvidedBufferNum   = 1 << 15
+	defaultRingManagerNum  = 4
+	defaultSubmitBatchSize = 10
+)
+
+// io_uring setup flags
+const (
+	setupSQPoll       = 1 << 1
+	setupSQAff        = 1 << 2
+	setupCoopTaskrun  = 1 << 8
+	setupSingleIssuer = 1 << 12
+)
+
+type RingOption struct {
+	f func(*ringOptions)
+}
+
+type ringOptions struct {
+	ringNum           int
+	entries           int
+	cqEntries         int
+	batchSize         int
+	flags             uint32
+	sqThreadIdle      time.Duration
+	bufferNum         int
+	bufferSize        int
+	zeroCopyThreshold int
+	epoll             bool
+	cpus              []int
+	autoAffinity      bool
+	sqCPUs            []int
+	// the CPUs of a single ring, -1 if it is not pinned
+	cpu   int
+	sqCPU int
+}
+
+// WithRingNum sets the number of rings the manager spreads connections over.
+func WithRingNum(n int) RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.ringNum = n
+		},
+	}
+}
+
+// WithRingEntries sets the size of the submission queue of every ring.
+func WithRingEntries(entries int) RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.entries = entries
+		},
+	}
+}
+
+// WithCQEntries sets the size of the completion queue of every ring, which
+// defaults to twice the submission queue.
+func WithCQEntries(entries int) RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.cqEntries = entries
+		},
+	}
+}
+
+// WithBatchSize sets how many requests are queued at most before the ring
+// enters the kernel to submit them.
+func WithBatchSize(n int) RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.batchSize = n
+		},
+	}
+}
+
+// WithSQPoll lets a kernel thread poll the submission queue, so submitting
+// needs no system call while the thread is awake. The thread goes to sleep
+// after idle without requests.
+func WithSQPoll(idle time.Duration) RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.flags |= setupSQPoll
+			op.sqThreadIdle = idle
+		},
+	}
+}
+
+// WithCoopTaskrun stops the kernel from interrupting the ring goroutines to
+// run completion work, it is run on the next entry into the kernel instead.
+func WithCoopTaskrun() RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.flags |= setupCoopTaskrun
+		},
+	}
+}
+
+// WithSingleIssuer tells the kernel that a single thread submits to each
+// ring. The submitting goroutine of every ring is locked to its OS thread.
+func WithSingleIssuer() RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.flags |= setupSingleIssuer
+		},
+	}
+}
+
+// WithSetupFlags adds raw IORING_SETUP_* flags to the ones set by the other
+// options.
+func WithSetupFlags(flags uint32) RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.flags |= flags
+		},
+	}
+}
+
+// WithProvidedBuffers gives every ring a shared pool of num buffers of size
+// bytes that the kernel picks from when data arrives, instead of every
+// connection reserving read space up front. num is rounded up to a power of
+// two as required by io_uring.
+func WithProvidedBuffers(num, size int) RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			n := 1
+			for n < num && n < maxProvidedBufferNum {
+				n <<= 1
+			}
+			op.bufferNum = n
+			op.bufferSize = size
+		},
+	}
+}
+
+// WithZeroCopySend sends writes of at least threshold bytes with zero copy
+// send requests, so the kernel transmits straight from the output buffer
+// instead of copying it into the socket. Smaller writes keep the plain path.
+func WithZeroCopySend(threshold int) RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.zeroCopyThreshold = threshold
+		},
+	}
+}
+
+// WithEpoll serves requests with epoll instead of io_uring, which is
+// otherwise only done when io_uring turns out to be unavailable. Zero copy
+// sends and provided buffers are not supported with epoll.
+func WithEpoll() RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.epoll = true
+		},
+	}
+}
+
+// WithCPUAffinity locks the completion and submission loops of every ring to
+// OS threads pinned to a CPU, ring i takes cpus[i%len(cpus)]. The kernel
+// poller of SQPOLL rings is pinned to the same CPU unless WithSQPollAffinity
+// says otherwise.
+func WithCPUAffinity(cpus ...int) RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.cpus = cpus
+		},
+	}
+}
+
+// WithAutoCPUAffinity is WithCPUAffinity over the CPUs the process may run on.
+func WithAutoCPUAffinity() RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.autoAffinity = true
+		},
+	}
+}
+
+// WithSQPollAffinity pins the kernel poller of SQPOLL ring i to
+// cpus[i%len(cpus)].
+func WithSQPollAffinity(cpus ...int) RingOption {
+	return RingOption{
+		f: func(op *ringOptions) {
+			op.sqCPUs = cpus
+		},
+	}
+}
+
+func newRingOptions(ops ...RingOption) *ringOptions {
+	opts := &ringOptions{
+		ringNum:   defaultRingManagerNum,
+		entries:   DEFAULT_RING_SIZE,
+		batchSize: defaultSubmitBatchSize,
+		cpu:       -1,
+		sqCPU:     -1,
+	}
+	for _, do := range ops {
+		do.f(opts)
+	}
+	if opts.batchSize > opts.entries/2 {
+		// a request may take a second entry for its linked timeout
+		opts.batchSize = opts.entries / 2
+	}
+	if opts.batchSize < 1 {
+		opts.batchSize = 1
+	}
+	return opts
+}
@@ -0,0 +1,579 @@
+//go:build !cgo || anet_purego
+
+package anet
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// io_uring opcodes
+const (
+	opNop         = 0
+	opSendMsg     = 9
+	opRecvMsg     = 10
+	opAccept      = 13
+	opAsyncCancel = 14
+	opLinkTimeout = 15
+	opConnect     = 16
+	opRead        = 22
+	opWrite       = 23
+	opRecv        = 27
+	opSplice      = 30
+	opSendZC      = 47
+	opSendMsgZC   = 48
+)
+
+const (
+	sqeIOLink       = 1 << 2
+	sqeBufferSelect = 1 << 5
+
+	acceptMultishot = 1 << 0
+	recvMultishot   = 1 << 1
+	asyncCancelAll  = 1 << 0
+	asyncCancelFD   = 1 << 1
+
+	setupCQSize    = 1 << 3
+	featSingleMmap = 1 << 0
+	enterGetEvents = 1 << 0
+	enterSQWakeup  = 1 << 1
+	enterSQWait    = 1 << 2
+	sqNeedWakeup   = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	registerPbufRing   = 22
+	unregisterPbufRing = 23
+)
+
+type sqringOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type cqringOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFD         uint32
+	resv         [3]uint32
+	sqOff        sqringOffsets
+	cqOff        cqringOffsets
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type uringBuf struct {
+	addr uint64
+	len  uint32
+	bid  uint16
+	resv uint16
+}
+
+type uringBufReg struct {
+	ringAddr    uint64
+	ringEntries uint32
+	bgid        uint16
+	flags       uint16
+	resv        [3]uint64
+}
+
+type kernelTimespec struct {
+	sec  int64
+	nsec int64
+}
+
+// defaultRing drives io_uring with raw system calls on the rings mapped into
+// the process, without cgo and liburing.
+type defaultRing struct {
+	ringCore
+	fd     int
+	sqpoll bool
+	sqMem  []byte
+	cqMem  []byte
+	sqeMem []byte
+
+	sqHead   *uint32
+	sqTail   *uint32
+	sqFlags  *uint32
+	sqMask   uint32
+	sqeArray []uringSQE
+	sqeTail  uint32
+
+	cqHead   *uint32
+	cqTail   *uint32
+	cqMask   uint32
+	cqeArray []uringCQE
+
+	bufRingMem []byte
+	bufMem     []byte
+	bufRing    []uringBuf
+	bufMu      sync.Mutex
+
+	// timespecs of linked timeouts, a slot is only reused after the ring has
+	// wrapped around so the kernel has read it by then
+	timespecs []kernelTimespec
+	tsn       int
+}
+
+func newDefaultRing(opts *ringOptions) (Ring, error) {
+	ring := &defaultRing{}
+	ring.init(opts)
+	err := ring.start(ring, opts)
+	if err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+func (r *defaultRing) setup(opts *ringOptions) error {
+	var params uringParams
+	params.flags = opts.flags
+	if opts.cqEntries > 0 {
+		params.flags |= setupCQSize
+		params.cqEntries = uint32(opts.cqEntries)
+	}
+	if opts.flags&setupSQPoll != 0 {
+		params.sqThreadIdle = uint32(opts.sqThreadIdle / time.Millisecond)
+		if opts.sqCPU >= 0 {
+			params.flags |= setupSQAff
+			params.sqThreadCPU = uint32(opts.sqCPU)
+		}
+	}
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(opts.entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return os.NewSyscallError("io_uring_setup", errno)
+	}
+	r.fd = int(fd)
+	r.sqpoll = params.flags&setupSQPoll != 0
+	err := r.mmap(&params)
+	if err != nil {
+		r.munmap()
+		_ = syscall.Close(r.fd)
+		return err
+	}
+	r.entries = int(params.sqEntries)
+	r.timespecs = make([]kernelTimespec, r.entries)
+	if opts.bufferNum > 0 {
+		err := r.setupBufferRing(opts.bufferNum, opts.bufferSize)
+		if err != nil {
+			log.Warnf("[ring %s] provided buffers are disabled: %s", r.id, err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *defaultRing) mmap(params *uringParams) error {
+	sqSize := int(params.sqOff.array + params.sqEntries*4)
+	cqSize := int(params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	single := params.features&featSingleMmap != 0
+	if single && cqSize > sqSize {
+		sqSize = cqSize
+	}
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	flags := syscall.MAP_SHARED | syscall.MAP_POPULATE
+	var err error
+	r.sqMem, err = syscall.Mmap(r.fd, offSQRing, sqSize, prot, flags)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	r.cqMem = r.sqMem
+	if !single {
+		r.cqMem, err = syscall.Mmap(r.fd, offCQRing, cqSize, prot, flags)
+		if err != nil {
+			return os.NewSyscallError("mmap", err)
+		}
+	}
+	r.sqeMem, err = syscall.Mmap(r.fd, offSQEs, int(params.sqEntries)*int(unsafe.Sizeof(uringSQE{})), prot, flags)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+
+	sq := unsafe.Pointer(&r.sqMem[0])
+	r.sqHead = (*uint32)(unsafe.Add(sq, params.sqOff.head))
+	r.sqTail = (*uint32)(unsafe.Add(sq, params.sqOff.tail))
+	r.sqFlags = (*uint32)(unsafe.Add(sq, params.sqOff.flags))
+	r.sqMask = *(*uint32)(unsafe.Add(sq, params.sqOff.ringMask))
+	r.sqeArray = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqeMem[0])), params.sqEntries)
+	r.sqeTail = atomic.LoadUint32(r.sqTail)
+	// entries are handed to the kernel in the order of their slots
+	array := unsafe.Slice((*uint32)(unsafe.Add(sq, params.sqOff.array)), params.sqEntries)
+	for i := range array {
+		array[i] = uint32(i)
+	}
+
+	cq := unsafe.Pointer(&r.cqMem[0])
+	r.cqHead = (*uint32)(unsafe.Add(cq, params.cqOff.head))
+	r.cqTail = (*uint32)(unsafe.Add(cq, params.cqOff.tail))
+	r.cqMask = *(*uint32)(unsafe.Add(cq, params.cqOff.ringMask))
+	r.cqeArray = unsafe.Slice((*uringCQE)(unsafe.Add(cq, params.cqOff.cqes)), params.cqEntries)
+	return nil
+}
+
+func (r *defaultRing) munmap() {
+	if r.sqeMem != nil {
+		_ = syscall.Munmap(r.sqeMem)
+		r.sqeMem = nil
+	}
+	if r.cqMem != nil && &r.cqMem[0] != &r.sqMem[0] {
+		_ = syscall.Munmap(r.cqMem)
+	}
+	r.cqMem = nil
+	if r.sqMem != nil {
+		_ = syscall.Munmap(r.sqMem)
+		r.sqMem = nil
+	}
+}
+
+func (r *defaultRing) enter(toSubmit, minComplete, flags uint32) (int, error) {
+	n, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+func (r *defaultRing) Wait() error {
+	for {
+		head := atomic.LoadUint32(r.cqHead)
+		tail := atomic.LoadUint32(r.cqTail)
+		if head == tail {
+			_, err := r.enter(0, 1, enterGetEvents)
+			if err != nil && err != syscall.EINTR && err != syscall.EAGAIN && err != syscall.EBUSY {
+				log.Warnf("[ring %s] failed to wait for completions: %s", r.id, err.Error())
+				return err
+			}
+			continue
+		}
+		atomic.LoadUint64(&r.batches)
+		closed := false
+		for ; head != tail; head++ {
+			cqe := &r.cqeArray[head&r.cqMask]
+			userData, res, flags := cqe.userData, cqe.res, cqe.flags
+			atomic.StoreUint32(r.cqHead, head+1)
+			r.handleEvent(userData, res, flags)
+			event, _ := decodeUserData(userData)
+			closed = closed || event == RingPrepNop
+		}
+		if closed {
+			<-r.stopped
+			r.onClose()
+			return nil
+		}
+	}
+}
+
+func (r *defaultRing) ProvidedBuffers() bool {
+	return r.bufRing != nil
+}
+
+func (r *defaultRing) RecycleBuffer(bid int) {
+	if r.bufRing == nil || bid < 0 || bid >= r.bufNum {
+		return
+	}
+	r.bufMu.Lock()
+	r.addBuffer(bid, 0)
+	r.advanceBuffers(1)
+	r.bufMu.Unlock()
+}
+
+func (r *defaultRing) setupBufferRing(num, size int) error {
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	flags := syscall.MAP_ANON | syscall.MAP_PRIVATE
+	ringMem, err := syscall.Mmap(-1, 0, num*int(unsafe.Sizeof(uringBuf{})), prot, flags)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	reg := uringBufReg{
+		ringAddr:    uint64(uintptr(unsafe.Pointer(&ringMem[0]))),
+		ringEntries: uint32(num),
+		bgid:        providedBufferGroup,
+	}
+	_, _, errno := syscall.Syscall6(sysIOUringRegister, uintptr(r.fd), registerPbufRing, uintptr(unsafe.Pointer(&reg)), 1, 0, 0)
+	if errno != 0 {
+		_ = syscall.Munmap(ringMem)
+		return os.NewSyscallError("io_uring_register", errno)
+	}
+	// the buffers live outside of the Go heap since the kernel keeps their
+	// addresses for as long as the ring exists
+	bufMem, err := syscall.Mmap(-1, 0, num*size, prot, flags)
+	if err != nil {
+		r.unregisterBufferRing()
+		_ = syscall.Munmap(ringMem)
+		return os.NewSyscallError("mmap", err)
+	}
+	r.bufRingMem = ringMem
+	r.bufMem = bufMem
+	r.bufRing = unsafe.Slice((*uringBuf)(unsafe.Pointer(&ringMem[0])), num)
+	r.bufBase = unsafe.Pointer(&bufMem[0])
+	r.bufNum = num
+	r.bufSize = size
+	for bid := 0; bid < num; bid++ {
+		r.addBuffer(bid, bid)
+	}
+	r.advanceBuffers(num)
+	return nil
+}
+
+func (r *defaultRing) unregisterBufferRing() {
+	reg := uringBufReg{bgid: providedBufferGroup}
+	_, _, _ = syscall.Syscall6(sysIOUringRegister, uintptr(r.fd), unregisterPbufRing, uintptr(unsafe.Pointer(&reg)), 1, 0, 0)
+}
+
+// bufTailWord is the word holding the tail of the buffer ring, which shares
+// the first entry with its bid so that it can be stored atomically.
+func (r *defaultRing) bufTailWord() *uint32 {
+	return (*uint32)(unsafe.Add(unsafe.Pointer(&r.bufRing[0]), 12))
+}
+
+func (r *defaultRing) addBuffer(bid, offset int) {
+	tail := int(atomic.LoadUint32(r.bufTailWord()) >> 16)
+	buf := &r.bufRing[(tail+offset)&(r.bufNum-1)]
+	buf.addr = uint64(uintptr(r.bufBase) + uintptr(bid*r.bufSize))
+	buf.len = uint32(r.bufSize)
+	buf.bid = uint16(bid)
+}
+
+func (r *defaultRing) advanceBuffers(n int) {
+	// io_uring is only found on little endian machines here, where the tail
+	// is the upper half of the word
+	word := r.bufTailWord()
+	old := atomic.LoadUint32(word)
+	tail := uint16(old>>16) + uint16(n)
+	atomic.StoreUint32(word, old&0xffff|uint32(tail)<<16)
+}
+
+func (r *defaultRing) getSQE() *uringSQE {
+	if r.sqSpace() == 0 {
+		return nil
+	}
+	sqe := &r.sqeArray[r.sqeTail&r.sqMask]
+	r.sqeTail++
+	return sqe
+}
+
+func (r *defaultRing) submit() {
+	atomic.StoreUint32(r.sqTail, r.sqeTail)
+	if r.sqpoll {
+		if atomic.LoadUint32(r.sqFlags)&sqNeedWakeup != 0 {
+			_, _ = r.enter(0, 0, enterSQWakeup)
+		}
+		return
+	}
+	for {
+		toSubmit := r.sqeTail - atomic.LoadUint32(r.sqHead)
+		if toSubmit == 0 {
+			return
+		}
+		_, err := r.enter(toSubmit, 0, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Warnf("[ring %s] failed to submit requests: %s", r.id, err.Error())
+		}
+		return
+	}
+}
+
+// reserve waits until the submission queue has room for n entries. It fills
+// up when the SQPOLL thread falls behind or a failed submission left its
+// entries queued, those are flushed again meanwhile.
+func (r *defaultRing) reserve(n int) {
+	for r.sqSpace() < uint32(n) {
+		atomic.AddUint64(&r.batches, 1)
+		r.submit()
+		if r.sqpoll {
+			_, err := r.enter(0, 0, enterSQWait)
+			if err == nil || err == syscall.EINTR {
+				continue
+			}
+		} else if r.sqSpace() >= uint32(n) {
+			return
+		}
+		// the completions reaped meanwhile let the next attempt through
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// sqSpace returns the number of entries that can be added to the submission
+// queue.
+func (r *defaultRing) sqSpace() uint32 {
+	return uint32(len(r.sqeArray)) - (r.sqeTail - atomic.LoadUint32(r.sqHead))
+}
+
+func prepRW(sqe *uringSQE, opcode uint8, fd int32, addr uint64, n uint32, off uint64) {
+	*sqe = uringSQE{}
+	sqe.opcode = opcode
+	sqe.fd = fd
+	sqe.addr = addr
+	sqe.len = n
+	sqe.off = off
+}
+
+func addrOf(p unsafe.Pointer) uint64 {
+	return uint64(uintptr(p))
+}
+
+func (r *defaultRing) prep(eventData RingEventData) {
+	// a request with a timeout takes a second entry, which has to follow it
+	// in the same submission
+	if eventData.Timeout > 0 {
+		r.reserve(2)
+	} else {
+		r.reserve(1)
+	}
+	sqe := r.getSQE()
+	if sqe == nil {
+		panic("should't failed here")
+	}
+	if eventData.Event == RingPrepNop {
+		prepRW(sqe, opNop, -1, 0, 0, 0)
+		sqe.userData = encodeUserData(RingPrepNop, 0)
+		r.num += 1
+		return
+	}
+	fd := int32(eventData.Operator.FD)
+	switch eventData.Event {
+	case RingPrepRead:
+		prepRW(sqe, opRead, fd, addrOf(unsafe.Pointer(&eventData.Data[0])), uint32(eventData.Size), 0)
+		sqe.userData = encodeUserData(RingPrepRead, eventData.Operator.FD)
+	case RingPrepWrite:
+		if r.zeroCopy(eventData) {
+			userData := encodeUserData(RingPrepSendZC, eventData.Operator.FD)
+			r.zcmap.Store(userData, &zeroCopySend{eventData: eventData})
+			prepRW(sqe, opSendZC, fd, addrOf(unsafe.Pointer(&eventData.Data[0])), uint32(eventData.Size), 0)
+			sqe.userData = userData
+			break
+		}
+		prepRW(sqe, opWrite, fd, addrOf(unsafe.Pointer(&eventData.Data[0])), uint32(eventData.Size), 0)
+		sqe.userData = encodeUserData(RingPrepWrite, eventData.Operator.FD)
+	case RingPrepConnect:
+		prepRW(sqe, opConnect, fd, addrOf(unsafe.Pointer(&eventData.Data[0])), 0, uint64(eventData.Size))
+		sqe.userData = encodeUserData(RingPrepConnect, eventData.Operator.FD)
+	case RingPrepAccept:
+		prepRW(sqe, opAccept, fd, 0, 0, 0)
+		sqe.opFlags = syscall.SOCK_CLOEXEC
+		if eventData.Multishot {
+			sqe.ioprio |= acceptMultishot
+		}
+		sqe.userData = encodeUserData(RingPrepAccept, eventData.Operator.FD)
+	case RingPrepRecvMsg:
+		prepRW(sqe, opRecvMsg, fd, addrOf(unsafe.Pointer(eventData.Msg)), 1, 0)
+		sqe.userData = encodeUserData(RingPrepRecvMsg, eventData.Operator.FD)
+	case RingPrepSendMsg:
+		if r.zeroCopy(eventData) {
+			userData := encodeUserData(RingPrepSendMsgZC, eventData.Operator.FD)
+			r.zcmap.Store(userData, &zeroCopySend{eventData: eventData})
+			prepRW(sqe, opSendMsgZC, fd, addrOf(unsafe.Pointer(eventData.Msg)), 1, 0)
+			sqe.userData = userData
+			break
+		}
+		prepRW(sqe, opSendMsg, fd, addrOf(unsafe.Pointer(eventData.Msg)), 1, 0)
+		sqe.userData = encodeUserData(RingPrepSendMsg, eventData.Operator.FD)
+	case RingPrepSplice:
+		prepRW(sqe, opSplice, int32(eventData.SpliceOut), uint64(eventData.SpliceOffset), uint32(eventData.Size), ^uint64(0))
+		sqe.spliceFDIn = int32(eventData.SpliceIn)
+		sqe.userData = encodeUserData(RingPrepSplice, eventData.Operator.FD)
+	case RingPrepCancel:
+		if eventData.CancelEvent != 0 {
+			prepRW(sqe, opAsyncCancel, -1, encodeUserData(eventData.CancelEvent, eventData.Operator.FD), 0, 0)
+			sqe.opFlags = asyncCancelAll
+		} else {
+			prepRW(sqe, opAsyncCancel, fd, 0, 0, 0)
+			sqe.opFlags = asyncCancelAll | asyncCancelFD
+		}
+		sqe.userData = encodeUserData(RingPrepCancel, eventData.Operator.FD)
+	case RingPrepRecv:
+		if eventData.Multishot {
+			prepRW(sqe, opRecv, fd, 0, 0, 0)
+			sqe.ioprio |= recvMultishot
+		} else {
+			prepRW(sqe, opRecv, fd, 0, uint32(r.bufSize), 0)
+		}
+		sqe.flags |= sqeBufferSelect
+		sqe.bufIndex = providedBufferGroup
+		sqe.userData = encodeUserData(RingPrepRecv, eventData.Operator.FD)
+	default:
+		panic("should't failed here")
+	}
+	if eventData.Timeout > 0 {
+		r.prepLinkTimeout(sqe, eventData)
+	}
+	r.num += 1
+}
+
+func (r *defaultRing) prepLinkTimeout(sqe *uringSQE, eventData RingEventData) {
+	tsqe := r.getSQE()
+	if tsqe == nil {
+		panic("should't failed here")
+	}
+	ts := &r.timespecs[r.tsn]
+	r.tsn = (r.tsn + 1) % len(r.timespecs)
+	ts.sec = int64(eventData.Timeout / time.Second)
+	ts.nsec = int64(eventData.Timeout % time.Second)
+	sqe.flags |= sqeIOLink
+	prepRW(tsqe, opLinkTimeout, -1, addrOf(unsafe.Pointer(ts)), 1, 0)
+	tsqe.userData = encodeUserData(RingPrepLinkTimeout, eventData.Operator.FD)
+	r.num += 1
+}
+
+func (r *defaultRing) onClose() {
+	if r.bufRing != nil {
+		r.unregisterBufferRing()
+		_ = syscall.Munmap(r.bufMem)
+		_ = syscall.Munmap(r.bufRingMem)
+		r.bufRing = nil
+	}
+	r.munmap()
+	_ = syscall.Close(r.fd)
+}
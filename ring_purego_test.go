@@ -0,0 +1,203 @@
+//go:build !cgo || anet_purego
+
+package anet
+
+import (
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sqCQOverflow is set in the flags of the submission queue while completions
+// wait in the overflow list of the kernel.
+const sqCQOverflow = 1 << 1
+
+// setupRawRing maps a ring without starting its goroutines, so that the test
+// drives the queues itself.
+func setupRawRing(t *testing.T, ops ...RingOption) *defaultRing {
+	opts := newRingOptions(ops...)
+	r := &defaultRing{}
+	r.init(opts)
+	err := r.setup(opts)
+	skipWithoutIOUring(t, err)
+	require.NoError(t, err)
+	t.Cleanup(r.onClose)
+	return r
+}
+
+// reap takes every completion off the completion queue.
+func reap(r *defaultRing) []uringCQE {
+	var cqes []uringCQE
+	head := *r.cqHead
+	for tail := *r.cqTail; head != tail; head++ {
+		cqes = append(cqes, r.cqeArray[head&r.cqMask])
+	}
+	*r.cqHead = head
+	return cqes
+}
+
+func TestRawRingLayout(t *testing.T) {
+	// the structs are shared with the kernel, so their sizes are fixed
+	require.Equal(t, uintptr(64), unsafe.Sizeof(uringSQE{}))
+	require.Equal(t, uintptr(16), unsafe.Sizeof(uringCQE{}))
+	require.Equal(t, uintptr(16), unsafe.Sizeof(uringBuf{}))
+	require.Equal(t, uintptr(40), unsafe.Sizeof(uringBufReg{}))
+	require.Equal(t, uintptr(120), unsafe.Sizeof(uringParams{}))
+
+	r := setupRawRing(t, WithRingEntries(8))
+	require.Equal(t, 8, r.entries)
+	require.Len(t, r.sqeArray, 8)
+	require.Equal(t, uint32(7), r.sqMask)
+	// the completion queue is twice as large unless set otherwise
+	require.Len(t, r.cqeArray, 16)
+	require.Equal(t, uint32(15), r.cqMask)
+	inside := func(mem []byte, p unsafe.Pointer) bool {
+		start := uintptr(unsafe.Pointer(&mem[0]))
+		return uintptr(p) >= start && uintptr(p) < start+uintptr(len(mem))
+	}
+	require.True(t, inside(r.sqMem, unsafe.Pointer(r.sqHead)))
+	require.True(t, inside(r.sqMem, unsafe.Pointer(r.sqTail)))
+	require.True(t, inside(r.sqMem, unsafe.Pointer(r.sqFlags)))
+	require.True(t, inside(r.cqMem, unsafe.Pointer(r.cqHead)))
+	require.True(t, inside(r.cqMem, unsafe.Pointer(r.cqTail)))
+	require.True(t, inside(r.cqMem, unsafe.Pointer(&r.cqeArray[15])))
+
+	// every slot reaches the kernel, twice around the ring
+	for i := 0; i < 16; i++ {
+		sqe := r.getSQE()
+		prepRW(sqe, opNop, -1, 0, 0, 0)
+		sqe.userData = uint64(i)
+		r.submit()
+		_, err := r.enter(0, 1, enterGetEvents)
+		require.NoError(t, err)
+		cqes := reap(r)
+		require.Len(t, cqes, 1)
+		require.Equal(t, uint64(i), cqes[0].userData)
+		require.Zero(t, cqes[0].res)
+	}
+	require.Equal(t, uint32(16), *r.sqHead)
+}
+
+func TestRawRingEncodesRequests(t *testing.T) {
+	r := setupRawRing(t, WithRingEntries(32), WithZeroCopySend(1024))
+	r.bufSize = 64
+	op := &FDOperator{FD: 7}
+	data := make([]byte, 2048)
+	msg := &syscall.Msghdr{}
+	addr := addrOf(unsafe.Pointer(&data[0]))
+	msgAddr := addrOf(unsafe.Pointer(msg))
+	for _, c := range []struct {
+		name      string
+		eventData RingEventData
+		want      uringSQE
+	}{
+		{"read", RingEventData{Event: RingPrepRead, Data: data, Size: 16},
+			uringSQE{opcode: opRead, fd: 7, addr: addr, len: 16, userData: encodeUserData(RingPrepRead, 7)}},
+		{"write", RingEventData{Event: RingPrepWrite, Data: data, Size: 16},
+			uringSQE{opcode: opWrite, fd: 7, addr: addr, len: 16, userData: encodeUserData(RingPrepWrite, 7)}},
+		{"zero copy write", RingEventData{Event: RingPrepWrite, Data: data, Size: 2048},
+			uringSQE{opcode: opSendZC, fd: 7, addr: addr, len: 2048, userData: encodeUserData(RingPrepSendZC, 7)}},
+		{"connect", RingEventData{Event: RingPrepConnect, Data: data, Size: 16},
+			uringSQE{opcode: opConnect, fd: 7, addr: addr, off: 16, userData: encodeUserData(RingPrepConnect, 7)}},
+		{"accept", RingEventData{Event: RingPrepAccept, Multishot: true},
+			uringSQE{opcode: opAccept, fd: 7, ioprio: acceptMultishot, opFlags: syscall.SOCK_CLOEXEC, userData: encodeUserData(RingPrepAccept, 7)}},
+		{"recvmsg", RingEventData{Event: RingPrepRecvMsg, Msg: msg},
+			uringSQE{opcode: opRecvMsg, fd: 7, addr: msgAddr, len: 1, userData: encodeUserData(RingPrepRecvMsg, 7)}},
+		{"sendmsg", RingEventData{Event: RingPrepSendMsg, Msg: msg, Size: 16},
+			uringSQE{opcode: opSendMsg, fd: 7, addr: msgAddr, len: 1, userData: encodeUserData(RingPrepSendMsg, 7)}},
+		{"zero copy sendmsg", RingEventData{Event: RingPrepSendMsg, Msg: msg, Size: 2048},
+			uringSQE{opcode: opSendMsgZC, fd: 7, addr: msgAddr, len: 1, userData: encodeUserData(RingPrepSendMsgZC, 7)}},
+		{"splice", RingEventData{Event: RingPrepSplice, SpliceIn: 3, SpliceOut: 7, SpliceOffset: 100, Size: 16},
+			uringSQE{opcode: opSplice, fd: 7, addr: 100, len: 16, off: ^uint64(0), spliceFDIn: 3, userData: encodeUserData(RingPrepSplice, 7)}},
+		{"cancel event", RingEventData{Event: RingPrepCancel, CancelEvent: RingPrepRead},
+			uringSQE{opcode: opAsyncCancel, fd: -1, addr: encodeUserData(RingPrepRead, 7), opFlags: asyncCancelAll, userData: encodeUserData(RingPrepCancel, 7)}},
+		{"cancel fd", RingEventData{Event: RingPrepCancel},
+			uringSQE{opcode: opAsyncCancel, fd: 7, opFlags: asyncCancelAll | asyncCancelFD, userData: encodeUserData(RingPrepCancel, 7)}},
+		{"recv", RingEventData{Event: RingPrepRecv},
+			uringSQE{opcode: opRecv, fd: 7, len: 64, flags: sqeBufferSelect, bufIndex: providedBufferGroup, userData: encodeUserData(RingPrepRecv, 7)}},
+		{"multishot recv", RingEventData{Event: RingPrepRecv, Multishot: true},
+			uringSQE{opcode: opRecv, fd: 7, ioprio: recvMultishot, flags: sqeBufferSelect, bufIndex: providedBufferGroup, userData: encodeUserData(RingPrepRecv, 7)}},
+	} {
+		c.eventData.Operator = op
+		tail := r.sqeTail
+		r.prep(c.eventData)
+		require.Equal(t, tail+1, r.sqeTail, c.name)
+		require.Equal(t, c.want, r.sqeArray[tail&r.sqMask], c.name)
+	}
+	_, ok := r.zcmap.Load(encodeUserData(RingPrepSendZC, 7))
+	require.True(t, ok)
+
+	// a timeout follows its request in the next entry, linked to it
+	tail := r.sqeTail
+	r.prep(RingEventData{Event: RingPrepRead, Data: data, Size: 16, Timeout: 1500 * time.Millisecond, Operator: op})
+	require.Equal(t, tail+2, r.sqeTail)
+	sqe := r.sqeArray[tail&r.sqMask]
+	require.Equal(t, uint8(opRead), sqe.opcode)
+	require.Equal(t, uint8(sqeIOLink), sqe.flags)
+	tsqe := r.sqeArray[(tail+1)&r.sqMask]
+	require.Equal(t, uint8(opLinkTimeout), tsqe.opcode)
+	require.Equal(t, int32(-1), tsqe.fd)
+	require.Equal(t, uint32(1), tsqe.len)
+	require.Equal(t, encodeUserData(RingPrepLinkTimeout, 7), tsqe.userData)
+	ts := &r.timespecs[0]
+	require.Equal(t, addrOf(unsafe.Pointer(ts)), tsqe.addr)
+	require.Equal(t, kernelTimespec{sec: 1, nsec: int64(500 * time.Millisecond)}, *ts)
+	require.Equal(t, 15, r.num)
+}
+
+func TestRawRingBufferRing(t *testing.T) {
+	r := setupRawRing(t, WithProvidedBuffers(4, 64))
+	if !r.ProvidedBuffers() {
+		t.Skip("the kernel has no provided buffer rings")
+	}
+	// every buffer is handed to the kernel in order of its bid
+	require.Equal(t, uint32(4), *r.bufTailWord()>>16)
+	for bid, buf := range r.bufRing {
+		require.Equal(t, uint64(uintptr(r.bufBase))+uint64(bid*64), buf.addr)
+		require.Equal(t, uint32(64), buf.len)
+		require.Equal(t, uint16(bid), buf.bid)
+	}
+
+	// a recycled buffer goes in at the tail, which wraps around the ring and
+	// shares its word with the first entry
+	r.RecycleBuffer(2)
+	require.Equal(t, uint32(5), *r.bufTailWord()>>16)
+	require.Equal(t, uint16(2), r.bufRing[0].bid)
+	require.Equal(t, uint16(5), r.bufRing[0].resv)
+	r.RecycleBuffer(-1)
+	r.RecycleBuffer(4)
+	require.Equal(t, uint32(5), *r.bufTailWord()>>16)
+}
+
+func TestRawRingCQOverflow(t *testing.T) {
+	r := setupRawRing(t, WithRingEntries(4))
+	require.Len(t, r.cqeArray, 8)
+
+	// more completions than the completion queue holds wait in the kernel
+	// instead of being dropped
+	for i := 0; i < 12; i++ {
+		sqe := r.getSQE()
+		prepRW(sqe, opNop, -1, 0, 0, 0)
+		sqe.userData = uint64(i)
+		if i%4 == 3 {
+			r.submit()
+		}
+	}
+	require.Equal(t, uint32(12), *r.sqHead)
+	require.NotZero(t, *r.sqFlags&sqCQOverflow)
+	cqes := reap(r)
+	require.Len(t, cqes, 8)
+
+	// the next wait flushes them into the queue in order
+	_, err := r.enter(0, 1, enterGetEvents)
+	require.NoError(t, err)
+	cqes = append(cqes, reap(r)...)
+	require.Len(t, cqes, 12)
+	for i, cqe := range cqes {
+		require.Equal(t, uint64(i), cqe.userData)
+	}
+	require.Zero(t, *r.sqFlags&sqCQOverflow)
+}
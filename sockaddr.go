@@ -0,0 +1,101 @@
+package anet
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+func sockaddrFromTCPAddr(addr *net.TCPAddr) ([]byte, int) {
+	return sockaddrFromIP(addr.IP, addr.Port, addr.Zone)
+}
+
+func sockaddrFromUDPAddr(addr *net.UDPAddr) ([]byte, int) {
+	return sockaddrFromIP(addr.IP, addr.Port, addr.Zone)
+}
+
+func sockaddrFromIP(ip net.IP, port int, zone string) ([]byte, int) {
+	if ip4 := ip.To4(); ip4 != nil {
+		raw := &syscall.RawSockaddrInet4{}
+		raw.Family = syscall.AF_INET
+		raw.Port = htons(uint16(port))
+		copy(raw.Addr[:], ip4)
+		return unsafe.Slice((*byte)(unsafe.Pointer(raw)), syscall.SizeofSockaddrInet4), syscall.AF_INET
+	}
+	raw := &syscall.RawSockaddrInet6{}
+	raw.Family = syscall.AF_INET6
+	raw.Port = htons(uint16(port))
+	copy(raw.Addr[:], ip.To16())
+	if zone != "" {
+		if ifi, err := net.InterfaceByName(zone); err == nil {
+			raw.Scope_id = uint32(ifi.Index)
+		}
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(raw)), syscall.SizeofSockaddrInet6), syscall.AF_INET6
+}
+
+func udpAddrFromSockaddr(raw *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch raw.Addr.Family {
+	case syscall.AF_INET:
+		raw4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(raw))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, raw4.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(htons(raw4.Port))}
+	case syscall.AF_INET6:
+		raw6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(raw))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, raw6.Addr[:])
+		addr := &net.UDPAddr{IP: ip, Port: int(htons(raw6.Port))}
+		if raw6.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(raw6.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	}
+	return nil
+}
+
+func sockaddrFromUnixAddr(addr *net.UnixAddr) ([]byte, int, error) {
+	raw := &syscall.RawSockaddrUnix{}
+	raw.Family = syscall.AF_UNIX
+	name := addr.Name
+	if len(name) >= len(raw.Path) {
+		return nil, 0, syscall.EINVAL
+	}
+	for i := 0; i < len(name); i++ {
+		raw.Path[i] = int8(name[i])
+	}
+	size := int(unsafe.Offsetof(raw.Path))
+	if len(name) > 0 {
+		size += len(name) + 1
+		// a leading '@' denotes an address in the abstract namespace
+		if name[0] == '@' {
+			raw.Path[0] = 0
+			size--
+		}
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(raw)), size), syscall.AF_UNIX, nil
+}
+
+func htons(port uint16) uint16 {
+	return port<<8 | port>>8
+}
+
+func netAddrFromSockaddr(sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		addr := &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				addr.Zone = ifi.Name
+			}
+		}
+		return addr
+	case *syscall.SockaddrUnix:
+		return &net.UnixAddr{Name: sa.Name, Net: "unix"}
+	}
+	return nil
+}